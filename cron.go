@@ -0,0 +1,120 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cron style schedule: minute, hour, day of the month, month and day of
+// the week, like "0 9 * * 1-5". Each field is a set of bits.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Like cron, when both days are given either of them will do
+	anyDom, anyDow bool
+}
+
+var cronRanges = []struct{ min, max int }{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronRanges) {
+		return nil, fmt.Errorf("a schedule needs %d fields: minute hour day month weekday", len(cronRanges))
+	}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronRanges[i].min, cronRanges[i].max)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	// Sunday is 0 or 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	schedule := &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		anyDom: strings.HasPrefix(fields[2], "*"), anyDow: strings.HasPrefix(fields[4], "*"),
+	}
+	if schedule.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%q never happens", spec)
+	}
+	return schedule, nil
+}
+
+// Fields are lists of *, numbers or ranges, each with an optional /step
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		stepped := false
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[slash+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in %q", field)
+			}
+			part, stepped = part[:slash], true
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad number in %q", field)
+			}
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad number in %q", field)
+				}
+			} else if !stepped {
+				high = low
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is out of range, it has to be %d-%d", field, min, max)
+		}
+		for value := low; value <= high; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, nil
+}
+
+func (schedule *cronSchedule) dayMatches(t time.Time) bool {
+	dom := schedule.dom&(1<<uint(t.Day())) != 0
+	dow := schedule.dow&(1<<uint(t.Weekday())) != 0
+	if !schedule.anyDom && !schedule.anyDow {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// The first minute after t that's on the schedule, in t's timezone, or
+// the zero time if there isn't one in the next few years
+func (schedule *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case schedule.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !schedule.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case schedule.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case schedule.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
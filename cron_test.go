@@ -0,0 +1,67 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, test := range []struct {
+		spec string
+		ok   bool
+	}{
+		{"0 9 * * 1-5", true},
+		{"*/15 * * * *", true},
+		{"0,30 8-18/2 1 1,6 0", true},
+		{"0 9 * * 7", true},
+		{"0 9 * *", false},
+		{"60 9 * * *", false},
+		{"0 24 * * *", false},
+		{"0 9 0 * *", false},
+		{"0 9 * 13 *", false},
+		{"0 9 * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"a * * * *", false},
+		{"0 9 30 2 *", false},
+	} {
+		_, err := parseCron(test.spec)
+		if (err == nil) != test.ok {
+			t.Errorf("parseCron(%q) = %v, wanted ok %t", test.spec, err, test.ok)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2014, 10, 1, 12, 34, 56, 0, time.UTC)
+	for _, test := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2014, 10, 1, 12, 35, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2014, 10, 2, 9, 0, 0, 0, time.UTC)},
+		{"0 13 * * *", time.Date(2014, 10, 1, 13, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2014, 10, 2, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 0", time.Date(2014, 10, 5, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2014, 10, 5, 9, 0, 0, 0, time.UTC)},
+		{"*/20 12 * * *", time.Date(2014, 10, 1, 12, 40, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2014, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day will do when both are given
+		{"0 9 15 * 5", time.Date(2014, 10, 3, 9, 0, 0, 0, time.UTC)},
+	} {
+		schedule, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %s", test.spec, err)
+			continue
+		}
+		if got := schedule.next(from); !got.Equal(test.want) {
+			t.Errorf("%q after %s = %s, wanted %s", test.spec, from, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// Everything that gets logged besides PRIVMSG and ACTION
+var channelEvents = []string{irc.JOIN, irc.PART, irc.QUIT, irc.NICK, irc.KICK, irc.TOPIC, irc.MODE}
+
+// Who is in which channel, keyed on the channel and the lowercased nick.
+// QUIT and NICK don't say which channels they happened in so this is
+// how they get logged in the right places.
+var presence = struct {
+	sync.RWMutex
+	channels map[string]map[string]string
+}{channels: make(map[string]map[string]string)}
+
+func joined(channel, nick string) {
+	presence.Lock()
+	defer presence.Unlock()
+	if presence.channels[channel] == nil {
+		presence.channels[channel] = make(map[string]string)
+	}
+	presence.channels[channel][strings.ToLower(nick)] = nick
+}
+
+func left(channel, nick string) {
+	presence.Lock()
+	defer presence.Unlock()
+	delete(presence.channels[channel], strings.ToLower(nick))
+}
+
+// Remove a nick from every channel, returning the ones it was in
+func quit(nick string) []string {
+	presence.Lock()
+	defer presence.Unlock()
+	var channels []string
+	for channel, nicks := range presence.channels {
+		if _, ok := nicks[strings.ToLower(nick)]; ok {
+			delete(nicks, strings.ToLower(nick))
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// Rename a nick everywhere, returning the channels it was in
+func renamed(oldNick, newNick string) []string {
+	presence.Lock()
+	defer presence.Unlock()
+	var channels []string
+	for channel, nicks := range presence.channels {
+		if _, ok := nicks[strings.ToLower(oldNick)]; ok {
+			delete(nicks, strings.ToLower(oldNick))
+			nicks[strings.ToLower(newNick)] = newNick
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// The channels a nick is in right now
+func channelsWith(nick string) []string {
+	presence.RLock()
+	defer presence.RUnlock()
+	var channels []string
+	for channel, nicks := range presence.channels {
+		if _, ok := nicks[strings.ToLower(nick)]; ok {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// RPL_NAMREPLY, sent after joining a channel
+func trackNames(conn *irc.Conn, line *irc.Line) {
+	if len(line.Args) < 4 {
+		return
+	}
+	for _, nick := range strings.Fields(line.Args[3]) {
+		joined(line.Args[2], strings.TrimLeft(nick, "@+%&~"))
+	}
+}
+
+// Log a line, returning its ID
+func insertMessage(line *irc.Line, channel, message string) (int64, error) {
+	result, err := db.Exec("insert into messages (Nick, Ident, Host, Src, Cmd, Channel,"+
+		" Message, Time) values (?, ?, ?, ?, ?, ?, ?, ?)", line.Nick, line.Ident,
+		line.Host, line.Src, line.Cmd, channel, message, line.Time)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func lineArg(line *irc.Line, i int) string {
+	if len(line.Args) > i {
+		return line.Args[i]
+	}
+	return ""
+}
+
+// Keep track of who's where and log it all
+func logEvent(conn *irc.Conn, line *irc.Line) {
+	var channels []string
+	var message string
+	switch line.Cmd {
+	case irc.JOIN:
+		channel := lineArg(line, 0)
+		if line.Nick == conn.Me().Nick {
+			presence.Lock()
+			delete(presence.channels, channel)
+			presence.Unlock()
+		}
+		joined(channel, line.Nick)
+		channels = []string{channel}
+	case irc.PART:
+		channels = []string{lineArg(line, 0)}
+		message = lineArg(line, 1)
+		left(channels[0], line.Nick)
+	case irc.KICK:
+		// The kicked nick goes first so it can be pulled back out
+		channels = []string{lineArg(line, 0)}
+		message = strings.TrimSpace(lineArg(line, 1) + " " + lineArg(line, 2))
+		left(channels[0], lineArg(line, 1))
+	case irc.QUIT:
+		channels = quit(line.Nick)
+		message = lineArg(line, 0)
+	case irc.NICK:
+		channels = renamed(line.Nick, lineArg(line, 0))
+		message = lineArg(line, 0)
+	case irc.TOPIC:
+		channels = []string{lineArg(line, 0)}
+		message = lineArg(line, 1)
+	case irc.MODE:
+		// User modes on the bot itself aren't interesting
+		if strings.IndexAny(lineArg(line, 0), "#&!+") != 0 {
+			return
+		}
+		channels = []string{lineArg(line, 0)}
+		message = strings.Join(line.Args[1:], " ")
+	}
+	if optedOut(line.Nick) {
+		return
+	}
+	for _, channel := range channels {
+		if _, err := insertMessage(line, channel, message); err != nil {
+			log.Println(err)
+		}
+	}
+	// QUIT and NICK happen everywhere at once, so they don't get a channel
+	seenChannel := ""
+	if line.Cmd != irc.QUIT && line.Cmd != irc.NICK && len(channels) == 1 {
+		seenChannel = channels[0]
+	}
+	if err := updateSeen(line, seenChannel, message); err != nil {
+		log.Println(err)
+	}
+}
+
+// What happened, for anything that isn't somebody talking. Returns ""
+// for PRIVMSG and ACTION.
+func describeEvent(line logLine) string {
+	switch line.Cmd {
+	case irc.JOIN:
+		return fmt.Sprintf("%s has joined", line.Nick)
+	case irc.PART:
+		return withReason(fmt.Sprintf("%s has left", line.Nick), line.Message)
+	case irc.QUIT:
+		return withReason(fmt.Sprintf("%s has quit", line.Nick), line.Message)
+	case irc.NICK:
+		return fmt.Sprintf("%s is now known as %s", line.Nick, line.Message)
+	case irc.KICK:
+		splitmessage := strings.SplitN(line.Message, " ", 2)
+		reason := ""
+		if len(splitmessage) > 1 {
+			reason = splitmessage[1]
+		}
+		return withReason(fmt.Sprintf("%s has kicked %s", line.Nick, splitmessage[0]), reason)
+	case irc.TOPIC:
+		return fmt.Sprintf("%s has changed the topic to: %s", line.Nick, line.Message)
+	case irc.MODE:
+		return fmt.Sprintf("%s sets mode %s", line.Nick, line.Message)
+	}
+	return ""
+}
+
+func withReason(text, reason string) string {
+	if reason == "" {
+		return text
+	}
+	return fmt.Sprintf("%s (%s)", text, reason)
+}
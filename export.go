@@ -0,0 +1,341 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const exportQuery = `SELECT ID, Nick, Cmd, UNIX_TIMESTAMP(Time), Message FROM messages ` +
+	`WHERE Channel = ? AND Time >= ? AND Time < ? AND ` + notOptedOut + ` ORDER BY Time, ID;`
+
+// Every format writes a header, each line, then a footer
+type logWriter interface {
+	Start(channel string, since time.Time) error
+	Line(line logLine) error
+	End(until time.Time) error
+}
+
+type exportFormat struct {
+	contentType string
+	extension   string
+	new         func(w io.Writer, loc *time.Location) logWriter
+}
+
+var exportFormats = map[string]exportFormat{
+	"irssi": {"text/plain; charset=utf-8", "log", func(w io.Writer, loc *time.Location) logWriter {
+		return &irssiWriter{w: w, loc: loc}
+	}},
+	"weechat": {"text/plain; charset=utf-8", "weechatlog", func(w io.Writer, loc *time.Location) logWriter {
+		return &weechatWriter{w: w, loc: loc}
+	}},
+	"jsonl": {"application/x-ndjson", "jsonl", func(w io.Writer, loc *time.Location) logWriter {
+		return &jsonWriter{enc: json.NewEncoder(w), loc: loc}
+	}},
+	"html": {"text/html; charset=utf-8", "html", func(w io.Writer, loc *time.Location) logWriter {
+		return &htmlWriter{w: w, loc: loc}
+	}},
+}
+
+func exportLocation(name string) (*time.Location, error) {
+	if name == "" {
+		name = config.Timezone
+	}
+	if name == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// Stream every line in the channel between since and until to w
+func exportLogs(w io.Writer, channel string, since, until time.Time, format string, loc *time.Location) error {
+	chosen, ok := exportFormats[format]
+	if !ok {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	writer := chosen.new(w, loc)
+	rows, err := db.Query(exportQuery, channel, since.UTC(), until.UTC())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if err := writer.Start(channel, since); err != nil {
+		return err
+	}
+	for rows.Next() {
+		var line logLine
+		var timestamp int64
+		if err := rows.Scan(&line.ID, &line.Nick, &line.Cmd, &timestamp, &line.Message); err != nil {
+			return err
+		}
+		line.Time = time.Unix(timestamp, 0)
+		if err := writer.Line(line); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writer.End(until)
+}
+
+// --- Log opened Wed Oct 01 00:00:00 2014
+// 12:34 <nick> hello
+// 12:34  * nick waves
+type irssiWriter struct {
+	w       io.Writer
+	loc     *time.Location
+	lastDay string
+}
+
+func (i *irssiWriter) Start(channel string, since time.Time) error {
+	_, err := fmt.Fprintf(i.w, "--- Log opened %s\n", since.In(i.loc).Format("Mon Jan 02 15:04:05 2006"))
+	i.lastDay = since.In(i.loc).Format("2006-01-02")
+	return err
+}
+
+func (i *irssiWriter) Line(line logLine) error {
+	t := line.Time.In(i.loc)
+	if day := t.Format("2006-01-02"); day != i.lastDay {
+		i.lastDay = day
+		if _, err := fmt.Fprintf(i.w, "--- Day changed %s\n", t.Format("Mon Jan 02 2006")); err != nil {
+			return err
+		}
+	}
+	var err error
+	if event := describeEvent(line); event != "" {
+		_, err = fmt.Fprintf(i.w, "%s -!- %s\n", t.Format("15:04"), event)
+	} else if line.Cmd == irc.ACTION {
+		_, err = fmt.Fprintf(i.w, "%s  * %s %s\n", t.Format("15:04"), line.Nick, line.Message)
+	} else {
+		_, err = fmt.Fprintf(i.w, "%s <%s> %s\n", t.Format("15:04"), line.Nick, line.Message)
+	}
+	return err
+}
+
+func (i *irssiWriter) End(until time.Time) error {
+	_, err := fmt.Fprintf(i.w, "--- Log closed %s\n", until.In(i.loc).Format("Mon Jan 02 15:04:05 2006"))
+	return err
+}
+
+// 2014-10-01 12:34:56	nick	hello
+// 2014-10-01 12:34:56	 *	nick waves
+// 2014-10-01 12:34:56	-->	nick has joined
+type weechatWriter struct {
+	w   io.Writer
+	loc *time.Location
+}
+
+func (wc *weechatWriter) Start(channel string, since time.Time) error { return nil }
+
+func (wc *weechatWriter) Line(line logLine) error {
+	stamp := line.Time.In(wc.loc).Format("2006-01-02 15:04:05")
+	var err error
+	if event := describeEvent(line); event != "" {
+		prefix := "--"
+		switch line.Cmd {
+		case irc.JOIN:
+			prefix = "-->"
+		case irc.PART, irc.QUIT, irc.KICK:
+			prefix = "<--"
+		}
+		_, err = fmt.Fprintf(wc.w, "%s\t%s\t%s\n", stamp, prefix, event)
+	} else if line.Cmd == irc.ACTION {
+		_, err = fmt.Fprintf(wc.w, "%s\t *\t%s %s\n", stamp, line.Nick, line.Message)
+	} else {
+		_, err = fmt.Fprintf(wc.w, "%s\t%s\t%s\n", stamp, line.Nick, line.Message)
+	}
+	return err
+}
+
+func (wc *weechatWriter) End(until time.Time) error { return nil }
+
+// One JSON object per line
+type jsonWriter struct {
+	enc     *json.Encoder
+	loc     *time.Location
+	channel string
+}
+
+type jsonLine struct {
+	ID      int64     `json:"id,omitempty"`
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	Nick    string    `json:"nick"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+}
+
+func (j *jsonWriter) Start(channel string, since time.Time) error {
+	j.channel = channel
+	return nil
+}
+
+func (j *jsonWriter) Line(line logLine) error {
+	return j.enc.Encode(jsonLine{
+		ID:      line.ID,
+		Time:    line.Time.In(j.loc),
+		Channel: j.channel,
+		Nick:    line.Nick,
+		Type:    line.Cmd,
+		Message: line.Message,
+	})
+}
+
+func (j *jsonWriter) End(until time.Time) error { return nil }
+
+// A single HTML file with the styles inlined so it can be passed around
+type htmlWriter struct {
+	w       io.Writer
+	loc     *time.Location
+	lastDay string
+}
+
+func (h *htmlWriter) Start(channel string, since time.Time) error {
+	_, err := fmt.Fprintf(h.w, `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>%s</title>
+<style>
+body { font-family: monospace; margin: 1em 2em; }
+.line { white-space: pre-wrap; }
+.time { color: #999; }
+.nick { font-weight: bold; }
+.event { color: #999; }
+</style></head><body>
+<h1>%s</h1>
+`, html.EscapeString(channel), html.EscapeString(channel))
+	return err
+}
+
+func (h *htmlWriter) Line(line logLine) error {
+	t := line.Time.In(h.loc)
+	if day := t.Format("2006-01-02"); day != h.lastDay {
+		h.lastDay = day
+		if _, err := fmt.Fprintf(h.w, "<h2>%s</h2>\n", day); err != nil {
+			return err
+		}
+	}
+	if event := describeEvent(line); event != "" {
+		_, err := fmt.Fprintf(h.w, `<div class="line event" id="l%d"><span class="time">%s</span> -- %s</div>`+"\n",
+			line.ID, t.Format("15:04:05"), html.EscapeString(event))
+		return err
+	}
+	nick := fmt.Sprintf(`<span class="nick" style="color:%s">%s</span>`, nickColour(line.Nick), html.EscapeString(line.Nick))
+	if line.Cmd == irc.ACTION {
+		nick = "* " + nick
+	} else {
+		nick = "&lt;" + nick + "&gt;"
+	}
+	_, err := fmt.Fprintf(h.w, `<div class="line" id="l%d"><span class="time">%s</span> %s %s</div>`+"\n",
+		line.ID, t.Format("15:04:05"), nick, html.EscapeString(line.Message))
+	return err
+}
+
+func (h *htmlWriter) End(until time.Time) error {
+	_, err := io.WriteString(h.w, "</body></html>\n")
+	return err
+}
+
+// sadbot export -channel '#geekhack' -since 2014-10-01 -until 2014-11-01 -format irssi
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	channel := flags.String("channel", "", "channel to export")
+	since := flags.String("since", "30d", "start of the export, a date or how long ago (7d, 2w, 12h)")
+	until := flags.String("until", "", "end of the export, defaults to now")
+	format := flags.String("format", "irssi", "irssi, weechat, jsonl or html")
+	tz := flags.String("tz", "", "timezone for the timestamps, defaults to the config's Timezone or UTC")
+	output := flags.String("o", "", "file to write to, defaults to stdout")
+	flags.Parse(args)
+
+	if *channel == "" {
+		log.Fatal("-channel is required")
+	}
+	loc, err := exportLocation(*tz)
+	if err != nil {
+		log.Fatal(err)
+	}
+	start, end, err := exportRange(*since, *until, loc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+	buffered := bufio.NewWriter(out)
+	if err := exportLogs(buffered, *channel, start, end, *format, loc); err != nil {
+		log.Fatal(err)
+	}
+	if err := buffered.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Dates are midnight where the export is being written for
+func exportRange(since, until string, loc *time.Location) (time.Time, time.Time, error) {
+	start, err := parseTimeArgIn(since, loc)
+	if err != nil {
+		return start, start, err
+	}
+	end := time.Now()
+	if until != "" {
+		end, err = parseTimeArgIn(until, loc)
+	}
+	return start, end, err
+}
+
+// /export?channel=geekhack&since=2014-10-01&until=2014-11-01&format=jsonl&tz=America/Chicago
+func webExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	channel, ok := webChannel(channelPath(query.Get("channel")))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "irssi"
+	}
+	chosen, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		return
+	}
+	since := query.Get("since")
+	if since == "" {
+		since = "1d"
+	}
+	loc, err := exportLocation(query.Get("tz"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end, err := exportRange(since, query.Get("until"), loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", chosen.contentType)
+	filename := strings.Replace(channelPath(channel)+"-"+start.Format("2006-01-02"), "/", "_", -1)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, filename, chosen.extension))
+	if err := exportLogs(w, channel, start, end, format, loc); err != nil {
+		log.Println("Error exporting logs:", err)
+	}
+}
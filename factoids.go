@@ -0,0 +1,443 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	factoidsTable = `CREATE TABLE IF NOT EXISTS factoids (
+    Channel VARCHAR(64) NOT NULL,
+    Name VARCHAR(64) NOT NULL,
+    Text TEXT NOT NULL,
+    Nick VARCHAR(32) NOT NULL,
+    ReadOnly BOOL NOT NULL DEFAULT FALSE,
+    Time DATETIME NOT NULL,
+    PRIMARY KEY (Channel, Name)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	// Text is NULL when the factoid was forgotten
+	factoidHistoryTable = `CREATE TABLE IF NOT EXISTS factoid_history (
+    ID INT NOT NULL AUTO_INCREMENT,
+    Channel VARCHAR(64) NOT NULL,
+    Name VARCHAR(64) NOT NULL,
+    Text TEXT NULL,
+    Nick VARCHAR(32) NOT NULL,
+    Time DATETIME NOT NULL,
+    PRIMARY KEY (ID),
+    KEY (Channel, Name)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	setFactoidQuery = `INSERT INTO factoids (Channel, Name, Text, Nick, ReadOnly, Time) VALUES (?, ?, ?, ?, ?, ?) ` +
+		`ON DUPLICATE KEY UPDATE Text=VALUES(Text), Nick=VALUES(Nick), ReadOnly=VALUES(ReadOnly), Time=VALUES(Time);`
+	forgetFactoidQuery  = `DELETE FROM factoids WHERE Channel = ? AND Name = ?;`
+	factoidHistoryQuery = `INSERT INTO factoid_history (Channel, Name, Text, Nick, Time) VALUES (?, ?, ?, ?, ?);`
+	// The channel's own factoid wins over a global one
+	findFactoidQuery = `SELECT Channel, Text, Nick, ReadOnly, UNIX_TIMESTAMP(Time) FROM factoids ` +
+		`WHERE Name = ? AND Channel IN (?, '') ORDER BY Channel DESC LIMIT 1;`
+	listFactoidsQuery     = `SELECT Name FROM factoids WHERE Channel IN (?, '') ORDER BY Name;`
+	readOnlyFactoidsQuery = `SELECT Channel, Name, Text FROM factoids WHERE ReadOnly;`
+	editsQuery            = `SELECT Text, Nick, UNIX_TIMESTAMP(Time) FROM factoid_history WHERE Channel = ? AND Name = ? ` +
+		`ORDER BY ID DESC LIMIT ?;`
+	editCountQuery = `SELECT COUNT(*) FROM factoid_history WHERE Channel = ? AND Name = ?;`
+	maxFactoidName = 64
+	factoidEdits   = 3
+	// Who the factoids from the config show up as
+	configNick = "config"
+)
+
+// Commands the bot already answers, which can't be taken over by a factoid
+var builtinCommands = map[string]bool{
+	"ask": true, "btc": true, "chatter": true, "cst": true, "dance": true, "expand": true,
+	"grep": true, "haata": true, "imitate": true, "karma": true, "last": true, "links": true,
+	"meebcast": true, "more": true, "privacy": true, "quote": true, "redact": true, "remind": true,
+	"roll": true, "seen": true, "stats": true, "tell": true, "titles": true, "w": true, "words": true,
+	"learn": true, "forget": true, "info": true,
+}
+
+type factoid struct {
+	Channel  string
+	Text     string
+	Nick     string
+	ReadOnly bool
+	Time     time.Time
+}
+
+// Who can !learn and !forget
+func canEditFactoids(line *irc.Line) bool {
+	if isAdmin(line) {
+		return true
+	}
+	for _, mask := range config.FactoidEditors {
+		if matchMask(mask, line) {
+			return true
+		}
+	}
+	return false
+}
+
+func findFactoid(name, channel string) (*factoid, error) {
+	var f factoid
+	var timestamp int64
+	err := db.QueryRow(findFactoidQuery, name, channel).Scan(&f.Channel, &f.Text, &f.Nick, &f.ReadOnly, &timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Time = time.Unix(timestamp, 0)
+	return &f, nil
+}
+
+// Change a factoid and remember what it was changed to. An empty text
+// forgets it.
+func setFactoid(channel, name, text, nick string, readOnly bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	history := sql.NullString{String: text, Valid: text != ""}
+	if text == "" {
+		_, err = tx.Exec(forgetFactoidQuery, channel, name)
+	} else {
+		_, err = tx.Exec(setFactoidQuery, channel, name, text, nick, readOnly, now)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(factoidHistoryQuery, channel, name, history, nick, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Config commands become read-only factoids, "default" ones global. Any
+// that have been taken out of the config are forgotten. They're said
+// as-is, and names that !learn would have treated differently from the
+// old exact match are skipped.
+func loadConfigFactoids() {
+	configFactoids := make(map[[2]string]string)
+	for _, commandConfig := range config.Commands {
+		channel := commandConfig.Channel
+		if channel == "default" {
+			channel = ""
+		}
+		for _, command := range commandConfig.Commands {
+			name := strings.TrimPrefix(command.Name, "!")
+			if !strings.HasPrefix(command.Name, "!") || name == "" || name != strings.ToLower(name) ||
+				len(name) > maxFactoidName || builtinCommands[name] {
+				log.Printf("Skipping config command %q, it needs to be ! and a lowercase name", command.Name)
+				continue
+			}
+			configFactoids[[2]string{channel, name}] = command.Text
+		}
+	}
+
+	rows, err := db.Query(readOnlyFactoidsQuery)
+	if err != nil {
+		log.Println("Error loading factoids:", err)
+		return
+	}
+	known := make(map[[2]string]string)
+	for rows.Next() {
+		var channel, name, text string
+		if err := rows.Scan(&channel, &name, &text); err != nil {
+			log.Println("Error loading factoids:", err)
+			rows.Close()
+			return
+		}
+		known[[2]string{channel, name}] = text
+	}
+	rows.Close()
+
+	for key, text := range known {
+		if _, ok := configFactoids[key]; !ok {
+			log.Printf("!%s isn't in the config anymore, forgetting it", key[1])
+			if err := setFactoid(key[0], key[1], "", configNick, false); err != nil {
+				log.Println("Error forgetting factoid:", err)
+			}
+			continue
+		}
+		if configFactoids[key] == text {
+			delete(configFactoids, key)
+		}
+	}
+	for key, text := range configFactoids {
+		if err := setFactoid(key[0], key[1], text, configNick, true); err != nil {
+			log.Println("Error importing factoid:", err)
+		}
+	}
+}
+
+// Fill in $nick, $channel and $args. $args is whoever ran it if nothing
+// was given.
+func expandFactoid(text, nick, channel, args string) string {
+	if args == "" {
+		args = nick
+	}
+	return strings.NewReplacer("$nick", nick, "$channel", channel, "$args", args).Replace(text)
+}
+
+// What a factoid says when alternate number pick comes up, and whether it's
+// a /me. Alternates are split up with |, and "<reply> text" says just the
+// text, "<action> text" does a /me and anything else comes out as "name is
+// text". A bare reply is pointed at whoever was named after the command,
+// like the old config commands.
+func factoidReply(name, text string, pick int, nick, channel string, args []string) (string, bool) {
+	alternates := strings.Split(text, "|")
+	text = strings.TrimSpace(alternates[pick])
+	// Alternates without their own <reply> or <action> go with the first one's
+	if !strings.HasPrefix(text, "<action>") && !strings.HasPrefix(text, "<reply>") {
+		first := strings.TrimSpace(alternates[0])
+		for _, form := range []string{"<action>", "<reply>"} {
+			if strings.HasPrefix(first, form) {
+				text = form + " " + text
+			}
+		}
+	}
+	switch {
+	case strings.HasPrefix(text, "<action>"):
+		text = strings.TrimSpace(strings.TrimPrefix(text, "<action>"))
+		return expandFactoid(text, nick, channel, strings.Join(args, " ")), true
+	case strings.HasPrefix(text, "<reply>"):
+		text = strings.TrimSpace(strings.TrimPrefix(text, "<reply>"))
+	default:
+		text = name + " is " + text
+	}
+	if len(args) > 0 && !strings.Contains(text, "$args") {
+		text = args[0] + ": " + text
+	}
+	return expandFactoid(text, nick, channel, strings.Join(args, " ")), false
+}
+
+// Answers !name with the factoid, see factoidReply. The ones from the
+// config are said exactly as written.
+func factoids(conn *irc.Conn, line *irc.Line) {
+	command := getCommand(line)
+	if !strings.HasPrefix(command, "!") {
+		return
+	}
+	name := strings.ToLower(command[1:])
+	if name == "" || builtinCommands[name] || len(name) > maxFactoidName {
+		return
+	}
+	f, err := findFactoid(name, line.Target())
+	if err != nil {
+		log.Println("Error fetching factoid:", err)
+		return
+	}
+	if f == nil {
+		return
+	}
+
+	args := strings.Fields(line.Text())[1:]
+	if f.ReadOnly {
+		text := f.Text
+		if len(args) > 0 {
+			text = args[0] + ": " + text
+		}
+		conn.Privmsg(line.Target(), text)
+		return
+	}
+	pick := rand.Intn(strings.Count(f.Text, "|") + 1)
+	reply, action := factoidReply(name, f.Text, pick, line.Nick, line.Target(), args)
+	if action {
+		conn.Action(line.Target(), reply)
+		return
+	}
+	conn.Privmsg(line.Target(), reply)
+}
+
+// Pulls "global" off the front of the args, for the factoids everywhere
+func factoidChannel(line *irc.Line, args []string) (string, []string) {
+	if len(args) > 0 && args[0] == "global" {
+		return "", args[1:]
+	}
+	return line.Target(), args
+}
+
+// !learn foo <reply> bar | baz, !learn global foo <action> waves at $args
+func learn(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!learn" {
+		return
+	}
+	if !canEditFactoids(line) {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: You can't teach me things.", line.Nick))
+		return
+	}
+	channel, args := factoidChannel(line, strings.Fields(line.Text())[1:])
+	if len(args) > 1 && args[1] == "is" {
+		args = append(args[:1], args[2:]...)
+	}
+	if len(args) < 2 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: !learn name text makes !name say it, add global to"+
+			" learn it everywhere. Start it with <reply> to say just the text or <action> for a /me,"+
+			" separate alternates with | and use $nick, $args and $channel.", line.Nick))
+		return
+	}
+	name := strings.ToLower(strings.TrimPrefix(args[0], "!"))
+	if name == "" || len(name) > maxFactoidName || builtinCommands[name] {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I can't learn !%s.", line.Nick, name))
+		return
+	}
+	existing, err := findFactoid(name, channel)
+	if err != nil {
+		log.Println("Error fetching factoid:", err)
+		return
+	}
+	if existing != nil && existing.Channel == channel && existing.ReadOnly {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: !%s comes from the config, it can't be changed here.",
+			line.Nick, name))
+		return
+	}
+	text := strings.Join(args[1:], " ")
+	for _, alternate := range strings.Split(text, "|") {
+		alternate = strings.TrimSpace(alternate)
+		alternate = strings.TrimPrefix(strings.TrimPrefix(alternate, "<reply>"), "<action>")
+		if strings.TrimSpace(alternate) == "" {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: There's nothing to say there.", line.Nick))
+			return
+		}
+	}
+	if err := setFactoid(channel, name, text, line.Nick, false); err != nil {
+		log.Println("Error saving factoid:", err)
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: Okay, !%s.", line.Nick, name))
+}
+
+// !forget foo, !forget global foo
+func forget(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!forget" {
+		return
+	}
+	if !canEditFactoids(line) {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: You can't make me forget things.", line.Nick))
+		return
+	}
+	channel, args := factoidChannel(line, strings.Fields(line.Text())[1:])
+	if len(args) != 1 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Forget what?", line.Nick))
+		return
+	}
+	name := strings.ToLower(strings.TrimPrefix(args[0], "!"))
+	existing, err := findFactoid(name, channel)
+	if err != nil {
+		log.Println("Error fetching factoid:", err)
+		return
+	}
+	if existing == nil || existing.Channel != channel {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I don't know !%s.", line.Nick, name))
+		return
+	}
+	if existing.ReadOnly {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: !%s comes from the config, it can't be changed here.",
+			line.Nick, name))
+		return
+	}
+	if err := setFactoid(channel, name, "", line.Nick, false); err != nil {
+		log.Println("Error forgetting factoid:", err)
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: Forgot !%s.", line.Nick, name))
+}
+
+// !info lists the factoids here, !info foo says where it came from and
+// !info foo history shows the last few versions
+func info(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!info" {
+		return
+	}
+	args := strings.Fields(line.Text())[1:]
+	if len(args) == 0 {
+		rows, err := db.Query(listFactoidsQuery, line.Target())
+		if err != nil {
+			log.Println("Error listing factoids:", err)
+			return
+		}
+		defer rows.Close()
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				log.Println("Error listing factoids:", err)
+				return
+			}
+			names = append(names, "!"+name)
+		}
+		if len(names) == 0 {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: I don't know anything yet.", line.Nick))
+			return
+		}
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I know %s", line.Nick, strings.Join(names, " ")))
+		return
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(args[0], "!"))
+	f, err := findFactoid(name, line.Target())
+	if err != nil {
+		log.Println("Error fetching factoid:", err)
+		return
+	}
+	if f == nil {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I don't know !%s.", line.Nick, name))
+		return
+	}
+	if len(args) > 1 && args[1] == "history" {
+		factoidHistory(conn, line, f.Channel, name)
+		return
+	}
+
+	var edits int
+	if err := db.QueryRow(editCountQuery, f.Channel, name).Scan(&edits); err != nil {
+		log.Println("Error fetching factoid history:", err)
+		return
+	}
+	where := "here"
+	if f.Channel == "" {
+		where = "everywhere"
+	}
+	readOnly := ""
+	if f.ReadOnly {
+		readOnly = ", it's from the config"
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: !%s (%s) was set by %s %s, %d edits%s: %s",
+		line.Nick, name, where, f.Nick, timeAgo(f.Time), edits, readOnly, f.Text))
+}
+
+func factoidHistory(conn *irc.Conn, line *irc.Line, channel, name string) {
+	rows, err := db.Query(editsQuery, channel, name, factoidEdits)
+	if err != nil {
+		log.Println("Error fetching factoid history:", err)
+		return
+	}
+	defer rows.Close()
+	var edits []string
+	for rows.Next() {
+		var text sql.NullString
+		var nick string
+		var timestamp int64
+		if err := rows.Scan(&text, &nick, &timestamp); err != nil {
+			log.Println("Error fetching factoid history:", err)
+			return
+		}
+		if !text.Valid {
+			text.String = "(forgotten)"
+		}
+		edits = append(edits, fmt.Sprintf("%s %s: %s", nick, timeAgo(time.Unix(timestamp, 0)), text.String))
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error fetching factoid history:", err)
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, strings.Join(edits, " / ")))
+}
@@ -0,0 +1,50 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestFactoidReply(t *testing.T) {
+	for _, test := range []struct {
+		text   string
+		pick   int
+		args   []string
+		want   string
+		action bool
+	}{
+		{"<reply> Be nice, $nick.", 0, nil, "Be nice, sadbox.", false},
+		{"<reply> Be nice.", 0, []string{"meeba"}, "meeba: Be nice.", false},
+		{"<reply> hi $args", 0, []string{"meeba", "too"}, "hi meeba too", false},
+		{"<reply> hi $args", 0, nil, "hi sadbox", false},
+		{"in the topic", 0, nil, "rules is in the topic", false},
+		{"<action> waves at $args in $channel", 0, []string{"meeba"}, "waves at meeba in #geekhack", true},
+		{"<reply> one | two | <action> three", 1, nil, "two", false},
+		{"<reply> one | two | <action> three", 2, nil, "three", true},
+		{"<action> hugs $nick | pats $nick", 1, nil, "pats sadbox", true},
+		{"first | second", 1, nil, "rules is second", false},
+	} {
+		got, action := factoidReply("rules", test.text, test.pick, "sadbox", "#geekhack", test.args)
+		if got != test.want || action != test.action {
+			t.Errorf("factoidReply(%q, %d, %q) = %q, %t, wanted %q, %t",
+				test.text, test.pick, test.args, got, action, test.want, test.action)
+		}
+	}
+}
+
+func TestExpandFactoid(t *testing.T) {
+	for _, test := range []struct {
+		text, args, want string
+	}{
+		{"$nick in $channel", "", "sadbox in #geekhack"},
+		{"hi $args", "", "hi sadbox"},
+		{"hi $args", "everyone", "hi everyone"},
+		{"$nick $nick", "", "sadbox sadbox"},
+		{"no vars", "x", "no vars"},
+	} {
+		if got := expandFactoid(test.text, "sadbox", "#geekhack", test.args); got != test.want {
+			t.Errorf("expandFactoid(%q, %q) = %q, wanted %q", test.text, test.args, got, test.want)
+		}
+	}
+}
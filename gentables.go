@@ -5,30 +5,159 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	wordCountsTable = `CREATE TABLE IF NOT EXISTS word_counts (
+    Nick VARCHAR(32) NOT NULL,
+    Channel VARCHAR(64) NOT NULL,
+    Word VARCHAR(32) NOT NULL,
+    Count INT NOT NULL DEFAULT 0,
+    LastUpdated DATETIME NOT NULL,
+    PRIMARY KEY (Nick, Channel, Word),
+    KEY (Channel, Word, Count)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	// Job is the word job still filling in the word's old counts, 0 once
+	// it's done. Words that came from BadWords go away when they're taken
+	// out of the config, ones added with !words track stick around.
+	trackedWordsTable = `CREATE TABLE IF NOT EXISTS tracked_words (
+    Word VARCHAR(32) NOT NULL,
+    Query VARCHAR(255) NOT NULL,
+    FromConfig BOOL NOT NULL DEFAULT FALSE,
+    Job INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (Word)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	// A pass over the logs counting some words. LastID is how far it's
+	// got, so it can pick up where it left off after a restart.
+	wordJobsTable = `CREATE TABLE IF NOT EXISTS word_jobs (
+    ID INT NOT NULL AUTO_INCREMENT,
+    StartedBy VARCHAR(32) NOT NULL DEFAULT '',
+    LastID BIGINT NOT NULL DEFAULT 0,
+    UpToID BIGINT NOT NULL,
+    Skipped INT NOT NULL DEFAULT 0,
+    Started DATETIME NOT NULL,
+    Finished DATETIME NULL,
+    PRIMARY KEY (ID)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	addWordCountQuery = `INSERT INTO word_counts (Nick, Channel, Word, Count, LastUpdated) VALUES (?, ?, ?, ?, ?) ` +
+		`ON DUPLICATE KEY UPDATE Count=Count+VALUES(Count), LastUpdated=GREATEST(LastUpdated, VALUES(LastUpdated));`
+	trackedWordsQuery = `SELECT Word, Query, FromConfig, Job, COALESCE(UpToID, 0) FROM tracked_words ` +
+		`LEFT JOIN word_jobs ON word_jobs.ID = tracked_words.Job;`
+	trackWordQuery = `INSERT INTO tracked_words (Word, Query, FromConfig) VALUES (?, ?, ?) ` +
+		`ON DUPLICATE KEY UPDATE Query=VALUES(Query), FromConfig=VALUES(FromConfig);`
+	untrackWordQuery = `DELETE FROM tracked_words WHERE Word = ?;`
+	clearWordQuery   = `DELETE FROM word_counts WHERE Word = ?;`
+	lastMessageQuery = `SELECT COALESCE(MAX(ID), 0) FROM messages;`
+	newJobQuery      = `INSERT INTO word_jobs (StartedBy, UpToID, Started) VALUES (?, ?, ?);`
+	assignJobQuery   = `UPDATE tracked_words SET Job = ? WHERE Word = ?;`
+	nextJobQuery     = `SELECT ID, StartedBy, LastID, UpToID, Skipped FROM word_jobs ` +
+		`WHERE Finished IS NULL ORDER BY ID LIMIT 1;`
+	checkpointQuery  = `UPDATE word_jobs SET LastID = ?, Skipped = ? WHERE ID = ?;`
+	finishJobQuery   = `UPDATE word_jobs SET Finished = ? WHERE ID = ?;`
+	jobDoneQuery     = `UPDATE tracked_words SET Job = 0 WHERE Job = ?;`
+	jobProgressQuery = `SELECT LastID FROM word_jobs WHERE ID = ?;`
+	uncountWordQuery = `UPDATE word_counts SET Count = GREATEST(Count - ?, 0) ` +
+		`WHERE Nick = ? AND Channel = ? AND Word = ?;`
+	jobBatchQuery = `SELECT ID, Nick, Channel, Message, UNIX_TIMESTAMP(Time) FROM messages ` +
+		`WHERE ID > ? AND ID <= ? AND Channel IN (%s) AND Cmd IN ('PRIVMSG', 'ACTION') AND ` +
+		notOptedOut + ` ORDER BY ID LIMIT ?;`
+	wordJobBatch = 5000
+	// How many times a batch gets retried before the job waits for later
+	maxBatchTries = 5
 )
 
-const baseTable = `CREATE TABLE words (
-    Nick VARCHAR(32),
-    %s
-    primary KEY (Nick)) ENGINE=InnoDB DEFAULT CHARSET=utf8;
-    `
+// A job counting a word back through the logs. Lines up to upTo are
+// left to it, anything after is counted live.
+type wordBackfill struct {
+	job  int64
+	upTo int64
+}
+
+// The words being counted, what they look like, and which job (if any)
+// is still counting them back through the logs
+var tracked = struct {
+	sync.RWMutex
+	words map[string]*regexp.Regexp
+	jobs  map[string]wordBackfill
+}{words: make(map[string]*regexp.Regexp), jobs: make(map[string]wordBackfill)}
+
+// Held while lines are being counted, live or by a job. Starting a job
+// takes it to clear out the old counts and pick its last line without one
+// slipping in between, and redacting takes it to see what's been counted.
+var counting sync.RWMutex
+
+// Pokes the word job worker when there's something new for it
+var wordJobsWaiting = make(chan bool, 1)
+
+// A snapshot of the tracked words, so nothing has to hold the lock
+// while it's busy with them.
+func trackedRegexps() map[string]*regexp.Regexp {
+	tracked.RLock()
+	defer tracked.RUnlock()
+	words := make(map[string]*regexp.Regexp, len(tracked.words))
+	for word, regex := range tracked.words {
+		words[word] = regex
+	}
+	return words
+}
+
+func trackedWords() []string {
+	tracked.RLock()
+	defer tracked.RUnlock()
+	var words []string
+	for word := range tracked.words {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	return words
+}
 
-func updateWords(nick, message string) error {
+// The name a word is tracked under, whatever case it's asked for in
+func trackedWord(word string) (string, bool) {
+	for _, name := range trackedWords() {
+		if strings.EqualFold(name, word) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// The words a new line should be counted for right away, leaving out the
+// ones a job is going to get to
+func liveWords(id int64) map[string]*regexp.Regexp {
+	tracked.RLock()
+	defer tracked.RUnlock()
+	words := make(map[string]*regexp.Regexp, len(tracked.words))
+	for word, regex := range tracked.words {
+		if backfill, ok := tracked.jobs[word]; ok && id <= backfill.upTo {
+			continue
+		}
+		words[word] = regex
+	}
+	return words
+}
+
+// Count a line that just got logged as messages.ID id
+func updateWords(id int64, nick, channel, message string, t time.Time) error {
+	counting.RLock()
+	defer counting.RUnlock()
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	for word, regex := range badWords {
+	for word, regex := range liveWords(id) {
 		numwords := len(regex.FindAllStringIndex(strings.ToLower(message), -1))
 		if numwords == 0 {
 			continue
 		}
-		_, err = tx.Exec(fmt.Sprintf(`INSERT INTO words (Nick, %[1]s) VALUES (?, ?)`+
-			` ON DUPLICATE KEY UPDATE %[1]s=%[1]s+VALUES(%[1]s)`, word), nick, numwords)
+		_, err = tx.Exec(addWordCountQuery, nick, channel, word, numwords, t.UTC())
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -41,61 +170,382 @@ func updateWords(nick, message string) error {
 	return nil
 }
 
-func genTables() {
-	log.Println("Regenerating Words table")
-	wordList := ""
-	for _, word := range config.BadWords {
-		wordList += word.Word + " INT(32) NOT NULL DEFAULT 0, "
+// Take redacted lines back out of the counts. Lines a job hasn't got to
+// yet were never counted, and it won't find them now.
+func uncountWords(channel string, lines []logLine) error {
+	counting.Lock()
+	defer counting.Unlock()
+	tracked.RLock()
+	words := make(map[string]*regexp.Regexp, len(tracked.words))
+	jobs := make(map[string]wordBackfill, len(tracked.jobs))
+	for word, regex := range tracked.words {
+		words[word] = regex
+		if backfill, ok := tracked.jobs[word]; ok {
+			jobs[word] = backfill
+		}
+	}
+	tracked.RUnlock()
+
+	progress := make(map[int64]int64)
+	for _, backfill := range jobs {
+		if _, ok := progress[backfill.job]; ok {
+			continue
+		}
+		var lastID int64
+		if err := db.QueryRow(jobProgressQuery, backfill.job).Scan(&lastID); err != nil {
+			return err
+		}
+		progress[backfill.job] = lastID
+	}
+
+	for _, line := range lines {
+		if line.Cmd != "PRIVMSG" && line.Cmd != "ACTION" {
+			continue
+		}
+		text := strings.ToLower(line.Message)
+		for word, regex := range words {
+			backfill, ok := jobs[word]
+			if ok && line.ID <= backfill.upTo && line.ID > progress[backfill.job] {
+				continue
+			}
+			found := len(regex.FindAllStringIndex(text, -1))
+			if found == 0 {
+				continue
+			}
+			if _, err := db.Exec(uncountWordQuery, found, line.Nick, channel, word); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	_, err := db.Exec(`DROP TABLE IF EXISTS words`)
+// Start counting a word and backfill it from the logs in the background
+func trackWord(word, query, startedBy string, fromConfig bool) error {
+	regex, err := regexp.Compile(query)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if _, err := db.Exec(trackWordQuery, word, query, fromConfig); err != nil {
+		return err
+	}
+	tracked.Lock()
+	tracked.words[word] = regex
+	tracked.Unlock()
+	return startWordJob([]string{word}, startedBy)
+}
+
+func untrackWord(word string) error {
+	tracked.Lock()
+	delete(tracked.words, word)
+	delete(tracked.jobs, word)
+	tracked.Unlock()
+	if _, err := db.Exec(untrackWordQuery, word); err != nil {
+		return err
 	}
-	_, err = db.Exec(fmt.Sprintf(baseTable, wordList))
+	_, err := db.Exec(clearWordQuery, word)
+	return err
+}
+
+// Throw away the counts for some words and queue up a pass over
+// everything logged so far. Live counting waits while the counts are
+// cleared and the job's last line is picked, and after that it leaves
+// everything up to that line to the job, so no line gets counted twice.
+func startWordJob(words []string, startedBy string) error {
+	counting.Lock()
+	defer counting.Unlock()
+	var upTo int64
+	if err := db.QueryRow(lastMessageQuery).Scan(&upTo); err != nil {
+		return err
+	}
+	result, err := db.Exec(newJobQuery, startedBy, upTo, time.Now().UTC())
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	genChan := make(chan struct {
-		Nick    string
-		Message string
-	})
-	wg := sync.WaitGroup{}
-	for i := 0; i < 100; i++ {
-		go func() {
-			for post := range genChan {
-				err := updateWords(post.Nick, post.Message)
-				if err != nil {
-					log.Fatal(err)
-				}
-				wg.Done()
-			}
-		}()
+		return err
 	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	// An older job that was counting any of these words leaves them alone now
+	for _, word := range words {
+		if _, err := db.Exec(assignJobQuery, id, word); err != nil {
+			return err
+		}
+		if _, err := db.Exec(clearWordQuery, word); err != nil {
+			return err
+		}
+		tracked.Lock()
+		tracked.jobs[word] = wordBackfill{job: id, upTo: upTo}
+		tracked.Unlock()
+	}
+	select {
+	case wordJobsWaiting <- true:
+	default:
+	}
+	return nil
+}
+
+type wordJob struct {
+	id        int64
+	startedBy string
+	lastID    int64
+	upToID    int64
+	skipped   int
+}
+
+// The words this job is still responsible for
+func (job *wordJob) words() map[string]*regexp.Regexp {
+	tracked.RLock()
+	defer tracked.RUnlock()
+	words := make(map[string]*regexp.Regexp)
+	for word, backfill := range tracked.jobs {
+		if backfill.job == job.id && tracked.words[word] != nil {
+			words[word] = tracked.words[word]
+		}
+	}
+	return words
+}
 
-	rows, err := db.Query(`SELECT Nick, Message from messages WHERE channel='#geekhack'`)
+func (job *wordJob) report(conn *irc.Conn, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("Word job %d: %s", job.id, message)
+	if conn != nil && job.startedBy != "" {
+		conn.Privmsg(job.startedBy, message)
+	}
+}
+
+// Count one batch of lines and save them along with how far it got.
+// Lines that can't be read are logged and skipped. Returns how many
+// lines it looked at.
+func (job *wordJob) batch(words map[string]*regexp.Regexp) (int, error) {
+	counting.RLock()
+	defer counting.RUnlock()
+	list, channels := sqlList(config.Channels)
+	query := fmt.Sprintf(jobBatchQuery, list)
+	args := append([]interface{}{job.lastID, job.upToID}, channels...)
+	rows, err := db.Query(query, append(args, wordJobBatch)...)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
+	}
+	defer rows.Close()
+
+	type key struct{ nick, channel, word string }
+	type tally struct {
+		count int
+		last  int64
 	}
+	tallies := make(map[key]*tally)
+	lastID, skipped, seen := job.lastID, job.skipped, 0
 	for rows.Next() {
-		var nick, message string
-		err := rows.Scan(&nick, &message)
+		seen++
+		var id int64
+		var nick, channel, message sql.NullString
+		var timestamp sql.NullInt64
+		if err := rows.Scan(&id, &nick, &channel, &message, &timestamp); err != nil {
+			log.Printf("Word job %d: skipping a line after %d: %s", job.id, lastID, err)
+			skipped++
+			continue
+		}
+		if id > lastID {
+			lastID = id
+		}
+		if !nick.Valid || !channel.Valid || !message.Valid || !timestamp.Valid {
+			log.Printf("Word job %d: skipping line %d, it's missing something", job.id, id)
+			skipped++
+			continue
+		}
+		text := strings.ToLower(message.String)
+		for word, regex := range words {
+			found := len(regex.FindAllStringIndex(text, -1))
+			if found == 0 {
+				continue
+			}
+			k := key{nick.String, channel.String, word}
+			if tallies[k] == nil {
+				tallies[k] = &tally{}
+			}
+			tallies[k].count += found
+			if timestamp.Int64 > tallies[k].last {
+				tallies[k].last = timestamp.Int64
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if seen > 0 && lastID == job.lastID {
+		return 0, fmt.Errorf("couldn't read any of the lines after %d", job.lastID)
+	}
+	if seen == 0 {
+		lastID = job.upToID
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for k, t := range tallies {
+		_, err := tx.Exec(addWordCountQuery, k.nick, k.channel, k.word, t.count, time.Unix(t.last, 0).UTC())
 		if err != nil {
-			log.Fatal(err)
+			tx.Rollback()
+			return 0, err
 		}
-		wg.Add(1)
-		genChan <- struct {
-			Nick    string
-			Message string
-		}{nick, message}
 	}
+	if _, err := tx.Exec(checkpointQuery, lastID, skipped, job.id); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	job.lastID, job.skipped = lastID, skipped
+	return seen, nil
+}
 
-	wg.Wait()
-	close(genChan)
+// Work through the job a batch at a time. Returns false if it had to
+// give up for now, it'll carry on from the last checkpoint next time.
+func (job *wordJob) run(conn *irc.Conn) bool {
+	job.report(conn, "Counting words in lines %d to %d", job.lastID+1, job.upToID)
+	lastReport := job.lastID * 10 / (job.upToID + 1)
+	counted := 0
+	for job.lastID < job.upToID {
+		words := job.words()
+		if len(words) == 0 {
+			// Everything it was counting got untracked or taken over
+			break
+		}
+		var seen int
+		var err error
+		for try := 1; try <= maxBatchTries; try++ {
+			if seen, err = job.batch(words); err == nil {
+				break
+			}
+			log.Printf("Word job %d: error on try %d after line %d: %s", job.id, try, job.lastID, err)
+			time.Sleep(time.Duration(try) * 10 * time.Second)
+		}
+		if err != nil {
+			job.report(conn, "Giving up at line %d for now: %s", job.lastID, err)
+			return false
+		}
+		counted += seen
+		if tenths := job.lastID * 10 / (job.upToID + 1); tenths > lastReport {
+			lastReport = tenths
+			job.report(conn, "%d%% done, %d lines counted and %d skipped", tenths*10, counted, job.skipped)
+		}
+	}
 
-	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+	if _, err := db.Exec(jobDoneQuery, job.id); err != nil {
+		log.Printf("Word job %d: error finishing: %s", job.id, err)
+		return false
 	}
-	log.Println("Finished generating Words!")
+	if _, err := db.Exec(finishJobQuery, time.Now().UTC(), job.id); err != nil {
+		log.Printf("Word job %d: error finishing: %s", job.id, err)
+		return false
+	}
+	tracked.Lock()
+	for word, backfill := range tracked.jobs {
+		if backfill.job == job.id {
+			delete(tracked.jobs, word)
+		}
+	}
+	tracked.Unlock()
+	job.report(conn, "All done, %d lines counted and %d skipped", counted, job.skipped)
+	return true
+}
+
+// Runs the word jobs one at a time, oldest first, including any that
+// were interrupted by a restart.
+func wordJobWorker(conn *irc.Conn) {
+	for {
+		var job wordJob
+		err := db.QueryRow(nextJobQuery).Scan(&job.id, &job.startedBy, &job.lastID, &job.upToID, &job.skipped)
+		if err == sql.ErrNoRows {
+			<-wordJobsWaiting
+			continue
+		}
+		if err != nil {
+			log.Println("Error fetching word jobs:", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		if !job.run(conn) {
+			time.Sleep(10 * time.Minute)
+		}
+	}
+}
+
+// Pick up the tracked words, adding and removing BadWords to match the
+// config. New words and ones whose query changed get counted back
+// through the logs.
+func loadTrackedWords() {
+	configWords := make(map[string]string)
+	for _, word := range config.BadWords {
+		configWords[word.Word] = word.Query
+	}
+
+	rows, err := db.Query(trackedWordsQuery)
+	if err != nil {
+		log.Println("Error loading tracked words:", err)
+		return
+	}
+	type trackedRow struct {
+		query      string
+		fromConfig bool
+		job        int64
+		upTo       int64
+	}
+	known := make(map[string]trackedRow)
+	for rows.Next() {
+		var word string
+		var row trackedRow
+		if err := rows.Scan(&word, &row.query, &row.fromConfig, &row.job, &row.upTo); err != nil {
+			log.Println("Error loading tracked words:", err)
+			rows.Close()
+			return
+		}
+		known[word] = row
+	}
+	rows.Close()
+
+	for word, row := range known {
+		query, inConfig := configWords[word]
+		switch {
+		case row.fromConfig && !inConfig:
+			log.Printf("%s isn't in BadWords anymore, forgetting its counts", word)
+			if err := untrackWord(word); err != nil {
+				log.Println("Error untracking word:", err)
+			}
+		case inConfig && query != row.query:
+			if err := trackWord(word, query, "", true); err != nil {
+				log.Printf("Error tracking %s: %s", word, err)
+			}
+		default:
+			regex, err := regexp.Compile(row.query)
+			if err != nil {
+				log.Printf("Error tracking %s: %s", word, err)
+				continue
+			}
+			tracked.Lock()
+			tracked.words[word] = regex
+			if row.job != 0 {
+				tracked.jobs[word] = wordBackfill{job: row.job, upTo: row.upTo}
+			}
+			tracked.Unlock()
+		}
+	}
+	for word, query := range configWords {
+		if _, ok := known[word]; ok {
+			continue
+		}
+		if err := trackWord(word, query, "", true); err != nil {
+			log.Printf("Error tracking %s: %s", word, err)
+		}
+	}
+}
+
+// Throw away every count and start over from the logs. startedBy gets
+// told how it's going, if it was started from IRC.
+func genTables(startedBy string) error {
+	log.Println("Recounting every tracked word")
+	return startWordJob(trackedWords(), startedBy)
 }
@@ -0,0 +1,205 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	messageIndexQuery = `SELECT COUNT(*) FROM information_schema.statistics WHERE ` +
+		`table_schema = DATABASE() AND table_name = 'messages' AND index_name = 'MessageText';`
+	addMessageIndex = `ALTER TABLE messages ADD FULLTEXT INDEX MessageText (Message);`
+	grepQuery       = `SELECT ID, Nick, Cmd, UNIX_TIMESTAMP(Time), Message FROM messages ` +
+		`WHERE %s ORDER BY Time DESC LIMIT %d;`
+	// Shorter words than this aren't in the full text index
+	minIndexedWord = 3
+	grepLimit      = 30
+)
+
+// Add the full text index on messages that !grep uses, this only happens
+// once and can take a while on a big table.
+func addGrepIndex() {
+	var count int
+	if err := db.QueryRow(messageIndexQuery).Scan(&count); err != nil {
+		log.Println("Error checking for the messages index:", err)
+		return
+	}
+	if count > 0 {
+		return
+	}
+	log.Println("Adding full text index to messages, this might take a bit")
+	if _, err := db.Exec(addMessageIndex); err != nil {
+		log.Println("Error adding full text index:", err)
+		return
+	}
+	log.Println("Finished adding full text index")
+}
+
+// Format a line from the messages table the way a client would show it
+func formatLogLine(line logLine) string {
+	stamp := line.Time.UTC().Format("2006-01-02 15:04")
+	if event := describeEvent(line); event != "" {
+		return fmt.Sprintf("[%s] -- %s", stamp, event)
+	}
+	if line.Cmd == irc.ACTION {
+		return fmt.Sprintf("[%s] * %s %s", stamp, line.Nick, line.Message)
+	}
+	return fmt.Sprintf("[%s] <%s> %s", stamp, line.Nick, line.Message)
+}
+
+// A search over the messages table, zero values don't filter anything
+type logSearch struct {
+	Channel string
+	Nick    string
+	Since   time.Time
+	Until   time.Time
+	// Plain text to look for, or a regex if it's wrapped in slashes
+	Pattern string
+}
+
+// One row from the messages table
+type logLine struct {
+	ID      int64
+	Nick    string
+	Cmd     string
+	Message string
+	Time    time.Time
+}
+
+// Find the most recent lines matching the search
+func (s logSearch) run(limit int) ([]logLine, error) {
+	conditions := []string{"Channel = ?", notOptedOut}
+	args := []interface{}{s.Channel}
+	if s.Nick != "" {
+		conditions = append(conditions, "Nick = ?")
+		args = append(args, s.Nick)
+	}
+	if !s.Since.IsZero() {
+		conditions = append(conditions, "Time >= ?")
+		args = append(args, s.Since.UTC())
+	}
+	if !s.Until.IsZero() {
+		conditions = append(conditions, "Time < ?")
+		args = append(args, s.Until.UTC())
+	}
+	if len(s.Pattern) > 2 && strings.HasPrefix(s.Pattern, "/") && strings.HasSuffix(s.Pattern, "/") {
+		conditions = append(conditions, "Message REGEXP ?")
+		args = append(args, s.Pattern[1:len(s.Pattern)-1])
+	} else if s.Pattern != "" {
+		// The index narrows things down to lines with all the words,
+		// then LIKE makes sure they're there as typed.
+		var required []string
+		for _, word := range strings.Fields(s.Pattern) {
+			word = strings.Trim(word, `+-<>()~*"@`)
+			if len(word) >= minIndexedWord {
+				required = append(required, "+"+word)
+			}
+		}
+		if len(required) > 0 {
+			conditions = append(conditions, "MATCH (Message) AGAINST (? IN BOOLEAN MODE)")
+			args = append(args, strings.Join(required, " "))
+		}
+		conditions = append(conditions, "Message LIKE ?")
+		args = append(args, "%"+escapeLike(s.Pattern)+"%")
+	}
+
+	rows, err := db.Query(fmt.Sprintf(grepQuery, strings.Join(conditions, " AND "), limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanLogLines(rows)
+}
+
+func scanLogLines(rows *sql.Rows) ([]logLine, error) {
+	var lines []logLine
+	for rows.Next() {
+		var line logLine
+		var timestamp int64
+		if err := rows.Scan(&line.ID, &line.Nick, &line.Cmd, &timestamp, &line.Message); err != nil {
+			return nil, err
+		}
+		line.Time = time.Unix(timestamp, 0)
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// !grep @nick #channel since:7d until:2014-10-01 some words
+// !grep /some.*regex/
+func grepLogs(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!grep" {
+		return
+	}
+	search := logSearch{Channel: line.Target()}
+	var words []string
+	for _, arg := range strings.Fields(line.Text())[1:] {
+		switch {
+		case arg == "help":
+			result := fmt.Sprintf("%s: Search the logs! @nick only shows lines from that nick, #channel searches"+
+				" another channel, since:7d and until:2014-10-01 limit the time and everything else is"+
+				" searched for. Wrap it in slashes to use a regex. (!grep @sadbox since:2w keycaps)", line.Nick)
+			conn.Privmsg(line.Target(), result)
+			return
+		case strings.HasPrefix(arg, "@"):
+			search.Nick = strings.TrimPrefix(arg, "@")
+		case strings.HasPrefix(arg, "#") && len(words) == 0:
+			search.Channel = arg
+		case strings.HasPrefix(arg, "since:"), strings.HasPrefix(arg, "until:"):
+			splitarg := strings.SplitN(arg, ":", 2)
+			t, err := parseTimeArg(splitarg[1])
+			if err != nil {
+				conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, err))
+				return
+			}
+			if splitarg[0] == "since" {
+				search.Since = t
+			} else {
+				search.Until = t
+			}
+		default:
+			words = append(words, arg)
+		}
+	}
+	search.Pattern = strings.Join(words, " ")
+	if search.Pattern == "" {
+		conn.Privmsg(line.Target(), "Example: !grep @sadbox keycaps")
+		return
+	}
+	here, _ := configuredChannel(line.Target())
+	channel, ok := configuredChannel(search.Channel)
+	if !ok {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I don't keep logs for %s.", line.Nick, search.Channel))
+		return
+	}
+	search.Channel = channel
+	if channel != here && channelOptions(channel).Private {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I can't show you %s's logs from here.", line.Nick, search.Channel))
+		return
+	}
+
+	lines, err := search.run(grepLimit)
+	if err != nil {
+		log.Println("Error searching logs:", err)
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: That search didn't work.", line.Nick))
+		return
+	}
+	if len(lines) == 0 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I couldn't find anything like that.", line.Nick))
+		return
+	}
+	var results []string
+	for _, found := range lines {
+		results = append(results, formatLogLine(found))
+	}
+	sendPaged(conn, line.Target(), line.Nick, results)
+}
@@ -0,0 +1,231 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	nickLinesQuery = `SELECT Message FROM messages WHERE Nick = ? AND Channel IN (%s) ` +
+		`AND Cmd IN ('PRIVMSG', 'ACTION') AND ` + notOptedOut + ` ORDER BY ID DESC LIMIT ?;`
+	channelLinesQuery = `SELECT Message FROM messages WHERE Channel IN (%s) ` +
+		`AND Cmd IN ('PRIVMSG', 'ACTION') AND ` + notOptedOut + ` ORDER BY ID DESC LIMIT ?;`
+	// Only this much of somebody's history goes into their model
+	maxModelLines = 50000
+	// Anyone with fewer lines than this doesn't get imitated
+	minModelLines = 20
+)
+
+// A markov chain for one nick or one channel, built when it's asked for
+type markovModel struct {
+	key      string
+	nick     string
+	channels []string
+	lines    int
+	chain    *Markov
+}
+
+// Whether a new line belongs in this model
+func (model *markovModel) wants(nick, channel string) bool {
+	if model.nick != "" && !strings.EqualFold(model.nick, nick) {
+		return false
+	}
+	for _, modelChannel := range model.channels {
+		if modelChannel == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// The models that have been built, most recently used at the front.
+// The oldest ones get thrown away once there's more than
+// MarkovCacheSize of them.
+var models = struct {
+	sync.Mutex
+	recent *list.List
+	byKey  map[string]*list.Element
+	// Models being built right now, so asking twice only builds once
+	building map[string]*modelBuild
+}{recent: list.New(), byKey: make(map[string]*list.Element), building: make(map[string]*modelBuild)}
+
+// A model that's being built, done is closed once it's ready
+type modelBuild struct {
+	done  chan struct{}
+	model *markovModel
+	err   error
+}
+
+func markovCacheSize() int {
+	if config.MarkovCacheSize < 1 {
+		return 20
+	}
+	return config.MarkovCacheSize
+}
+
+// Fetch a model from the cache or build it. nick is "" for a model of
+// everyone in the channels.
+func getModel(nick string, channels []string) (*markovModel, error) {
+	key := strings.ToLower(nick) + " " + strings.Join(channels, ",")
+	models.Lock()
+	if element, ok := models.byKey[key]; ok {
+		models.recent.MoveToFront(element)
+		models.Unlock()
+		return element.Value.(*markovModel), nil
+	}
+	if build, ok := models.building[key]; ok {
+		models.Unlock()
+		<-build.done
+		return build.model, build.err
+	}
+	build := &modelBuild{done: make(chan struct{})}
+	models.building[key] = build
+	models.Unlock()
+
+	build.model, build.err = buildModel(key, nick, channels)
+	// Somebody could have opted out while it was being built. Checked
+	// before taking the lock, opting out takes them the other way around.
+	keep := build.err == nil && (nick == "" || !optedOut(nick))
+	models.Lock()
+	delete(models.building, key)
+	if keep {
+		models.byKey[key] = models.recent.PushFront(build.model)
+		for models.recent.Len() > markovCacheSize() {
+			oldest := models.recent.Back()
+			models.recent.Remove(oldest)
+			delete(models.byKey, oldest.Value.(*markovModel).key)
+		}
+	}
+	models.Unlock()
+	close(build.done)
+	return build.model, build.err
+}
+
+// Train a model on the logs
+func buildModel(key, nick string, channels []string) (*markovModel, error) {
+	model := &markovModel{key: key, nick: nick, channels: channels, chain: &Markov{}}
+	model.chain.Init(markovOrder())
+	placeholders, args := sqlList(channels)
+	query := fmt.Sprintf(channelLinesQuery, placeholders)
+	if nick != "" {
+		query = fmt.Sprintf(nickLinesQuery, placeholders)
+		args = append([]interface{}{nick}, args...)
+	}
+	rows, err := db.Query(query, append(args, maxModelLines)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			return nil, err
+		}
+		model.chain.Add(message)
+		model.lines++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+// Teach a new line to any cached models it belongs in
+func learnModels(nick, channel, message string) {
+	models.Lock()
+	defer models.Unlock()
+	for element := models.recent.Front(); element != nil; element = element.Next() {
+		model := element.Value.(*markovModel)
+		if model.wants(nick, channel) {
+			model.chain.Add(message)
+			model.lines++
+		}
+	}
+}
+
+// Throw away everything cached about a nick, for when they opt out.
+// Channel models get rebuilt without them too.
+func forgetModels(nick string) {
+	models.Lock()
+	defer models.Unlock()
+	for element := models.recent.Front(); element != nil; {
+		next := element.Next()
+		model := element.Value.(*markovModel)
+		if model.nick == "" || strings.EqualFold(model.nick, nick) {
+			models.recent.Remove(element)
+			delete(models.byKey, model.key)
+		}
+		element = next
+	}
+}
+
+// !imitate sadbox, !imitate sadbox cats, !imitate #geekhack
+func imitate(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!imitate" {
+		return
+	}
+	args := strings.Fields(line.Text())[1:]
+	if len(args) == 0 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: !imitate nick makes something up that they'd say,"+
+			" !imitate nick cats makes it about cats. It works on channels too.", line.Nick))
+		return
+	}
+	who, seed := args[0], args[1:]
+
+	// Lines from private channels only get used inside them
+	channels := webChannels()
+	here, _ := configuredChannel(line.Target())
+	if here != "" && channelOptions(here).Private {
+		channels = append(channels, here)
+	}
+	nick := who
+	if strings.HasPrefix(who, "#") {
+		channel, ok := configuredChannel(who)
+		if !ok {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: I don't keep logs for %s.", line.Nick, who))
+			return
+		}
+		if channelOptions(channel).Private && channel != here {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s is private.", line.Nick, who))
+			return
+		}
+		nick, channels = "", []string{channel}
+	} else if optedOut(who) {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s has asked not to be logged.", line.Nick, who))
+		return
+	}
+
+	model, err := getModel(nick, channels)
+	if err != nil {
+		log.Println("Error building markov model:", err)
+		return
+	}
+	models.Lock()
+	lines := model.lines
+	models.Unlock()
+	if lines < minModelLines {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I haven't heard enough from %s.", line.Nick, who))
+		return
+	}
+	var chatter string
+	if len(seed) > 0 {
+		chatter = model.chain.GenerateFrom(seed)
+	} else {
+		chatter = model.chain.Generate(1)
+	}
+	if chatter == "" {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I can't think of anything %s would say about that.",
+			line.Nick, who))
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("<%s> %s", who, chatter))
+}
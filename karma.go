@@ -0,0 +1,272 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	karmaTable = `CREATE TABLE IF NOT EXISTS karma (
+    ID INT NOT NULL AUTO_INCREMENT,
+    Channel VARCHAR(64) NOT NULL,
+    Thing VARCHAR(64) NOT NULL,
+    Nick VARCHAR(32) NOT NULL,
+    Delta TINYINT NOT NULL,
+    Time DATETIME NOT NULL,
+    PRIMARY KEY (ID),
+    KEY (Channel, Thing),
+    KEY (Channel, Nick, Time)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	addKarmaQuery   = `INSERT INTO karma (Channel, Thing, Nick, Delta, Time) VALUES (?, ?, ?, ?, ?);`
+	karmaScoreQuery = `SELECT COALESCE(SUM(Delta), 0), COALESCE(SUM(Delta > 0), 0), COALESCE(SUM(Delta < 0), 0) ` +
+		`FROM karma WHERE Channel = ? AND Thing = ?;`
+	karmaTopQuery = `SELECT Thing, SUM(Delta) AS Score FROM karma WHERE Channel = ? ` +
+		`GROUP BY Thing HAVING Score %s 0 ORDER BY Score %s LIMIT ?;`
+	// How much karma a nick has given lately, and how much of it to one thing
+	karmaGivenQuery = `SELECT COUNT(*), COALESCE(SUM(Thing = ?), 0) FROM karma ` +
+		`WHERE Channel = ? AND Nick = ? AND Time >= ?;`
+	karmaHistoryQuery = `SELECT ID, Nick, Delta, UNIX_TIMESTAMP(Time) FROM karma WHERE Channel = ? AND Thing = ? ` +
+		`ORDER BY ID DESC LIMIT ?;`
+	undoKarmaQuery     = `DELETE FROM karma WHERE Channel = ? AND ID = ?;`
+	undoNickKarmaQuery = `DELETE FROM karma WHERE Channel = ? AND Nick = ? AND Time >= ?;`
+	// How long before the same nick can change the same thing again, and
+	// how many changes they get in that time altogether
+	karmaCooldown    = 10 * time.Minute
+	karmaPerCooldown = 5
+	// Only this many things can be changed by one line
+	maxKarmaPerLine = 5
+	maxKarmaLength  = 64
+	karmaLeaders    = 5
+	karmaHistory    = 5
+)
+
+var (
+	// (multi word thing)++
+	karmaPhrase = regexp.MustCompile(`\(([^()]+)\)(\+\+|--)`)
+	// foo++, foo-bar--, [nick]++, with some punctuation allowed after
+	karmaWord = regexp.MustCompile(`^([\w\[\]{}|^` + "`" + `\\]+(?:[-.][\w\[\]{}|^` + "`" + `\\]+)*)(\+\+|--)[,.;:!?]*$`)
+)
+
+type karmaChange struct {
+	thing string
+	delta int
+}
+
+// Lowercased with the spaces squashed, so "(Free Beer)" and
+// "(free  beer)" are the same thing
+func karmaThing(thing string) string {
+	return strings.ToLower(strings.Join(strings.Fields(thing), " "))
+}
+
+// Pick the ++ and -- out of a line
+func findKarma(text string) []karmaChange {
+	var changes []karmaChange
+	add := func(thing, op string) {
+		thing = karmaThing(thing)
+		if thing == "" || len(thing) > maxKarmaLength || len(changes) >= maxKarmaPerLine {
+			return
+		}
+		delta := 1
+		if op == "--" {
+			delta = -1
+		}
+		changes = append(changes, karmaChange{thing, delta})
+	}
+	for _, match := range karmaPhrase.FindAllStringSubmatch(text, -1) {
+		add(match[1], match[2])
+	}
+	for _, word := range strings.Fields(karmaPhrase.ReplaceAllString(text, " ")) {
+		if match := karmaWord.FindStringSubmatch(word); match != nil {
+			add(match[1], match[2])
+		}
+	}
+	return changes
+}
+
+// Whether somebody's trying to change their own karma
+func ownKarma(thing, nick string) bool {
+	return thing == karmaThing(nick)
+}
+
+// Watches channel lines for foo++ and foo--
+func karma(conn *irc.Conn, line *irc.Line) {
+	channel := line.Target()
+	if !strings.HasPrefix(channel, "#") || strings.HasPrefix(line.Text(), "!") || optedOut(line.Nick) {
+		return
+	}
+	for _, change := range findKarma(line.Text()) {
+		if ownKarma(change.thing, line.Nick) {
+			conn.Privmsg(channel, fmt.Sprintf("%s: Nice try.", line.Nick))
+			continue
+		}
+		// Counted from the table so a restart doesn't reset anybody
+		var given, givenThing int
+		since := time.Now().UTC().Add(-karmaCooldown)
+		if err := db.QueryRow(karmaGivenQuery, change.thing, channel, line.Nick, since).Scan(&given, &givenThing); err != nil {
+			log.Println("Error checking karma:", err)
+			return
+		}
+		if given >= karmaPerCooldown {
+			return
+		}
+		if givenThing > 0 {
+			continue
+		}
+
+		if _, err := db.Exec(addKarmaQuery, channel, change.thing, line.Nick, change.delta, time.Now().UTC()); err != nil {
+			log.Println("Error recording karma:", err)
+		}
+	}
+}
+
+func karmaScore(conn *irc.Conn, line *irc.Line, thing string) {
+	var score, up, down int
+	if err := db.QueryRow(karmaScoreQuery, line.Target(), thing).Scan(&score, &up, &down); err != nil {
+		log.Println("Error fetching karma:", err)
+		return
+	}
+	if up == 0 && down == 0 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s doesn't have any karma.", line.Nick, thing))
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s has %d karma (%d up, %d down).",
+		line.Nick, thing, score, up, down))
+}
+
+func karmaLeaderboard(conn *irc.Conn, line *irc.Line, which string) {
+	sign, order := ">", "DESC"
+	if which == "bottom" {
+		sign, order = "<", "ASC"
+	}
+	counts, err := countQuery(fmt.Sprintf(karmaTopQuery, sign, order), line.Target(), karmaLeaders)
+	if err != nil {
+		log.Println("Error fetching karma:", err)
+		return
+	}
+	if len(counts) == 0 {
+		what := "any"
+		if which == "bottom" {
+			what = "negative"
+		}
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Nobody has %s karma yet.", line.Nick, what))
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, joinCounts(counts, "%s (%.0f)")))
+}
+
+// The last few changes to a thing, with the numbers admins need to undo them
+func karmaChanges(conn *irc.Conn, line *irc.Line, thing string) {
+	rows, err := db.Query(karmaHistoryQuery, line.Target(), thing, karmaHistory)
+	if err != nil {
+		log.Println("Error fetching karma history:", err)
+		return
+	}
+	defer rows.Close()
+	var changes []string
+	for rows.Next() {
+		var id, delta, timestamp int64
+		var nick string
+		if err := rows.Scan(&id, &nick, &delta, &timestamp); err != nil {
+			log.Println("Error fetching karma history:", err)
+			return
+		}
+		op := "++"
+		if delta < 0 {
+			op = "--"
+		}
+		changes = append(changes, fmt.Sprintf("[%d] %s%s from %s %s", id, thing, op, nick, timeAgo(time.Unix(timestamp, 0))))
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error fetching karma history:", err)
+		return
+	}
+	if len(changes) == 0 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Nobody has changed %s's karma.", line.Nick, thing))
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, strings.Join(changes, ", ")))
+}
+
+// !karma undo 12 13 takes back changes by number (from !karma history)
+// !karma undo @nick 1d takes back everything nick did in the last day
+func undoKarma(conn *irc.Conn, line *irc.Line, args []string) {
+	if !isAdmin(line) {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Only admins can do that.", line.Nick))
+		return
+	}
+	if len(args) == 0 {
+		conn.Privmsg(line.Target(), "Example: !karma undo 1234 1235 or !karma undo @sadbox 1d")
+		return
+	}
+	var undone int64
+	if strings.HasPrefix(args[0], "@") {
+		period := "1d"
+		if len(args) > 1 {
+			period = args[1]
+		}
+		since, err := parseTimeArg(period)
+		if err != nil {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, err))
+			return
+		}
+		result, err := db.Exec(undoNickKarmaQuery, line.Target(), args[0][1:], since.UTC())
+		if err != nil {
+			log.Println("Error undoing karma:", err)
+			return
+		}
+		undone, _ = result.RowsAffected()
+	} else {
+		for _, arg := range args {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s isn't a karma change.", line.Nick, arg))
+				return
+			}
+			result, err := db.Exec(undoKarmaQuery, line.Target(), id)
+			if err != nil {
+				log.Println("Error undoing karma:", err)
+				return
+			}
+			affected, _ := result.RowsAffected()
+			undone += affected
+		}
+	}
+	log.Printf("%s undid %d karma changes in %s", line.Nick, undone, line.Target())
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: Undid %d karma changes.", line.Nick, undone))
+}
+
+// !karma foo, !karma top, !karma bottom, !karma history foo, !karma undo 12
+func showKarma(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!karma" || !strings.HasPrefix(line.Target(), "#") {
+		return
+	}
+	args := strings.Fields(line.Text())[1:]
+	if len(args) == 0 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Give karma with thing++ or (some thing)--, then"+
+			" !karma thing, !karma top, !karma bottom or !karma history thing.", line.Nick))
+		return
+	}
+	switch args[0] {
+	case "top", "bottom":
+		karmaLeaderboard(conn, line, args[0])
+	case "history":
+		if len(args) < 2 {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: The history of what?", line.Nick))
+			return
+		}
+		karmaChanges(conn, line, karmaThing(strings.Trim(strings.Join(args[1:], " "), "()")))
+	case "undo":
+		undoKarma(conn, line, args[1:])
+	default:
+		karmaScore(conn, line, karmaThing(strings.Trim(strings.Join(args, " "), "()")))
+	}
+}
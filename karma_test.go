@@ -0,0 +1,51 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindKarma(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want []karmaChange
+	}{
+		{"go++", []karmaChange{{"go", 1}}},
+		{"Rust-- is fine", []karmaChange{{"rust", -1}}},
+		{"(Free  Beer)++ and (mondays)--", []karmaChange{{"free beer", 1}, {"mondays", -1}}},
+		{"foo-bar++, [nick]++!", []karmaChange{{"foo-bar", 1}, {"[nick]", 1}}},
+		{"c++ is a language", []karmaChange{{"c", 1}}},
+		{"i++; j--", []karmaChange{{"i", 1}, {"j", -1}}},
+		{"a++ b++ c++ d++ e++ f++", []karmaChange{{"a", 1}, {"b", 1}, {"c", 1}, {"d", 1}, {"e", 1}}},
+		{"x+++ ++y -- nothing", nil},
+		{"() ++", nil},
+		{"(" + strings.Repeat("a", maxKarmaLength+1) + ")++", nil},
+		{"just talking", nil},
+	} {
+		if got := findKarma(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("findKarma(%q) = %v, wanted %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestOwnKarma(t *testing.T) {
+	for _, test := range []struct {
+		thing, nick string
+		want        bool
+	}{
+		{"sadbox", "sadbox", true},
+		{"sadbox", "SadBox", true},
+		{"[nick]", "[Nick]", true},
+		{"sadbox", "meeba", false},
+		{"sadbox bot", "sadbox", false},
+	} {
+		if got := ownKarma(test.thing, test.nick); got != test.want {
+			t.Errorf("ownKarma(%q, %q) = %t, wanted %t", test.thing, test.nick, got, test.want)
+		}
+	}
+}
@@ -8,15 +8,39 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	irc "github.com/fluffle/goirc/client"
 )
 
-const lastSeenQuery = `select Time, Message from messages where ` +
-	`channel = ? and Nick = ? order by Time desc limit 1`
+const lastSeenQuery = `select UNIX_TIMESTAMP(Time), Cmd, Message from messages where ` +
+	`channel = ? and Nick = ? and ` + notOptedOut + ` order by Time desc limit 1`
+
+// How the last thing somebody did reads after "last seen",
+// like "quitting 2 hours ago (Ping timeout)"
+func seenDoing(line logLine) string {
+	ago := timeAgo(line.Time)
+	switch line.Cmd {
+	case irc.JOIN:
+		return "joining " + ago
+	case irc.PART:
+		return withReason("leaving "+ago, line.Message)
+	case irc.QUIT:
+		return withReason("quitting "+ago, line.Message)
+	case irc.NICK:
+		return fmt.Sprintf("changing their nick to %s %s", line.Message, ago)
+	case irc.KICK:
+		return fmt.Sprintf("kicking %s %s", strings.SplitN(line.Message, " ", 2)[0], ago)
+	case irc.TOPIC:
+		return fmt.Sprintf("changing the topic %s: %s", ago, line.Message)
+	case irc.MODE:
+		return fmt.Sprintf("setting mode %s %s", line.Message, ago)
+	}
+	return ""
+}
 
 func lastSeen(conn *irc.Conn, line *irc.Line) {
-	if !strings.HasPrefix(line.Text(), "!last") {
+	if getCommand(line) != "!last" {
 		return
 	}
 	nick := strings.TrimSpace(strings.TrimPrefix(line.Text(), "!last"))
@@ -24,15 +48,19 @@ func lastSeen(conn *irc.Conn, line *irc.Line) {
 	if err != nil {
 		log.Println("Error while preparing query for last message:", err)
 	}
-	var timestamp, message string
+	var seen logLine
+	var timestamp int64
 	for rows.Next() {
-		if err := rows.Scan(&timestamp, &message); err != nil {
+		if err := rows.Scan(&timestamp, &seen.Cmd, &seen.Message); err != nil {
 			log.Println("Error fetching from the db:", err)
 		}
 	}
+	seen.Time = time.Unix(timestamp, 0)
 	result := ""
-	if timestamp != "" {
-		result = fmt.Sprintf("%s: %s UTC <%s> %s", line.Nick, timestamp, nick, message)
+	if doing := seenDoing(seen); timestamp != 0 && doing != "" {
+		result = fmt.Sprintf("%s: %s was last seen %s", line.Nick, nick, doing)
+	} else if timestamp != 0 {
+		result = fmt.Sprintf("%s: %s UTC <%s> %s", line.Nick, seen.Time.UTC().Format("2006-01-02 15:04:05"), nick, seen.Message)
 	} else {
 		result = fmt.Sprintf("%s: I haven't seen %s", line.Nick, nick)
 	}
@@ -0,0 +1,177 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	linksTable = `CREATE TABLE IF NOT EXISTS links (
+    ID INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    URLHash CHAR(40) NOT NULL,
+    URL TEXT NOT NULL,
+    Host VARCHAR(255) NOT NULL DEFAULT '',
+    Nick VARCHAR(32) NOT NULL,
+    Channel VARCHAR(64) NOT NULL,
+    Time DATETIME NOT NULL,
+    Title VARCHAR(512) NOT NULL DEFAULT '',
+    PRIMARY KEY (ID),
+    UNIQUE KEY (Channel, URLHash),
+    KEY (Channel, Time)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	findLinkQuery    = `SELECT Nick, UNIX_TIMESTAMP(Time) FROM links WHERE Channel = ? AND URLHash = ?;`
+	searchLinksQuery = `SELECT Nick, UNIX_TIMESTAMP(Time), URL, Title FROM links WHERE %s ORDER BY Time DESC LIMIT %d;`
+	addLinkQuery     = `INSERT IGNORE INTO links (URLHash, URL, Host, Nick, Channel, Time, Title) VALUES (?, ?, ?, ?, ?, ?, ?);`
+)
+
+// Most results !links will page through
+const linkSearchLimit = 30
+
+// The first time a link was posted in a channel
+type linkPost struct {
+	Nick string
+	Time time.Time
+}
+
+// Reduce a URL to something that compares equal for the "same" link,
+// http vs https, www., fragments, tracking junk and trailing slashes are all ignored.
+func normalizeURL(postedUrl *url.URL) string {
+	host := strings.ToLower(postedUrl.Host)
+	host = strings.TrimPrefix(host, "www.")
+	host = strings.TrimSuffix(host, ":80")
+	host = strings.TrimSuffix(host, ":443")
+
+	query := postedUrl.Query()
+	for key := range query {
+		if strings.HasPrefix(key, "utm_") {
+			query.Del(key)
+		}
+	}
+
+	normalized := host + strings.TrimRight(postedUrl.EscapedPath(), "/")
+	if encoded := query.Encode(); encoded != "" {
+		normalized += "?" + encoded
+	}
+	return normalized
+}
+
+func hashURL(normalized string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(normalized)))
+}
+
+// Returns nil if the link hasn't been posted in the channel before
+func findLink(channel string, postedUrl *url.URL) (*linkPost, error) {
+	var post linkPost
+	var timestamp int64
+	err := db.QueryRow(findLinkQuery, channel, hashURL(normalizeURL(postedUrl))).Scan(&post.Nick, &timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	post.Time = time.Unix(timestamp, 0)
+	return &post, nil
+}
+
+func recordLink(channel, nick string, postedUrl *url.URL, title string) error {
+	if runes := []rune(title); len(runes) > 512 {
+		title = string(runes[:512])
+	}
+	host := strings.TrimPrefix(strings.ToLower(postedUrl.Host), "www.")
+	_, err := db.Exec(addLinkQuery, hashURL(normalizeURL(postedUrl)), postedUrl.String(),
+		host, nick, channel, time.Now().UTC(), title)
+	return err
+}
+
+// Escape the wildcards in a string that's going into a LIKE
+func escapeLike(pattern string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(pattern)
+}
+
+// !links @nick domain:github.com since:7d until:2014-10-01 words in the title
+func searchLinks(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!links" {
+		return
+	}
+	conditions := []string{"Channel = ?", notOptedOut}
+	args := []interface{}{line.Target()}
+	var titleWords []string
+	for _, arg := range strings.Fields(line.Text())[1:] {
+		switch {
+		case arg == "help":
+			result := fmt.Sprintf("%s: Search old links! @nick will only show links from that nick,"+
+				" domain:github.com only links to that site, since:7d and until:2014-10-01 limit the time,"+
+				" and anything else has to be in the title. (!links @sadbox domain:github.com since:7d keycaps)", line.Nick)
+			conn.Privmsg(line.Target(), result)
+			return
+		case strings.HasPrefix(arg, "@"):
+			conditions = append(conditions, "Nick = ?")
+			args = append(args, strings.TrimPrefix(arg, "@"))
+		case strings.HasPrefix(arg, "domain:"):
+			domain := strings.TrimPrefix(strings.ToLower(strings.TrimPrefix(arg, "domain:")), "www.")
+			conditions = append(conditions, "(Host = ? OR Host LIKE ?)")
+			args = append(args, domain, "%."+escapeLike(domain))
+		case strings.HasPrefix(arg, "since:"), strings.HasPrefix(arg, "until:"):
+			splitarg := strings.SplitN(arg, ":", 2)
+			t, err := parseTimeArg(splitarg[1])
+			if err != nil {
+				conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, err))
+				return
+			}
+			if splitarg[0] == "since" {
+				conditions = append(conditions, "Time >= ?")
+			} else {
+				conditions = append(conditions, "Time < ?")
+			}
+			args = append(args, t.UTC())
+		default:
+			titleWords = append(titleWords, arg)
+		}
+	}
+	if len(titleWords) > 0 {
+		conditions = append(conditions, "Title LIKE ?")
+		args = append(args, "%"+escapeLike(strings.Join(titleWords, " "))+"%")
+	}
+
+	query := fmt.Sprintf(searchLinksQuery, strings.Join(conditions, " AND "), linkSearchLimit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Println("Error searching links:", err)
+		return
+	}
+	defer rows.Close()
+	var results []string
+	for rows.Next() {
+		var nick, link, title string
+		var timestamp int64
+		if err := rows.Scan(&nick, &timestamp, &link, &title); err != nil {
+			log.Println("Error fetching from the db:", err)
+			return
+		}
+		result := fmt.Sprintf("[%s] <%s> %s", timeAgo(time.Unix(timestamp, 0)), nick, link)
+		if title != "" {
+			result += " - " + title
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error fetching from the db:", err)
+		return
+	}
+	if len(results) == 0 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I couldn't find any links like that.", line.Nick))
+		return
+	}
+	sendPaged(conn, line.Target(), line.Nick, results)
+}
@@ -0,0 +1,313 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	// Only rows that were there before the import started count, so lines
+	// that really were said twice in the file both make it in
+	duplicateQuery = `SELECT COUNT(*) FROM messages WHERE Channel = ? AND Nick = ? ` +
+		`AND Message = ? AND Time >= ? AND Time < ? AND ID <= ?;`
+	importQuery = `INSERT INTO messages (Nick, Ident, Host, Src, Cmd, Channel, Message, Time) ` +
+		`VALUES (?, '', '', ?, ?, ?, ?, ?);`
+	// How many unparseable lines get printed in the report
+	maxReportedLines = 20
+)
+
+var (
+	// --- Log opened Wed Oct 01 00:00:00 2014
+	// --- Day changed Thu Oct 02 2014
+	irssiDay     = regexp.MustCompile(`^--- (?:Log opened|Day changed) \w+ (\w+ \d+) (?:\d\d:\d\d:\d\d )?(\d{4})`)
+	irssiMessage = regexp.MustCompile(`^(\d\d:\d\d(?::\d\d)?) <[ @+%&~]?([^>]+)> ?(.*)$`)
+	irssiAction  = regexp.MustCompile(`^(\d\d:\d\d(?::\d\d)?)  \* (\S+) ?(.*)$`)
+	irssiEvent   = regexp.MustCompile(`^(\d\d:\d\d(?::\d\d)?) -!- |^--- Log closed`)
+	// [12:34:56] <nick> message
+	zncMessage = regexp.MustCompile(`^\[(\d\d:\d\d:\d\d)\] <[@+%&~]?([^>]+)> ?(.*)$`)
+	zncAction  = regexp.MustCompile(`^\[(\d\d:\d\d:\d\d)\] \* (\S+) ?(.*)$`)
+	zncEvent   = regexp.MustCompile(`^\[(\d\d:\d\d:\d\d)\] \*\*\* `)
+	// ZNC names its logs after the day, #chan_20141001.log or 2014-10-01.log
+	fileDate = regexp.MustCompile(`(\d{4})-?(\d\d)-?(\d\d)`)
+)
+
+// Why lines didn't make it into the messages table
+type importReport struct {
+	imported   int
+	duplicates int
+	optedOut   int
+	events     int
+	unparsed   int
+	examples   []string
+}
+
+func (r *importReport) skip(file string, lineNumber int, text string) {
+	r.unparsed++
+	if len(r.examples) < maxReportedLines {
+		r.examples = append(r.examples, fmt.Sprintf("%s:%d: %s", file, lineNumber, text))
+	}
+}
+
+// A line from a log file that's something somebody said
+type importedLine struct {
+	nick      string
+	cmd       string
+	message   string
+	time      time.Time
+	precision time.Duration
+}
+
+// What the line parsers say about lines that aren't
+var (
+	errLogEvent   = errors.New("a join, part or other event")
+	errUnreadable = errors.New("couldn't read the line")
+)
+
+type logImporter struct {
+	format  string
+	channel string
+	loc     *time.Location
+	tx      *sql.Tx
+	report  importReport
+	// The last row from before the import, and how many of the rows
+	// already there each line of the file has matched
+	lastID  int64
+	matched map[string]int
+}
+
+// Only the formats with seconds in them can be matched to the second,
+// the rest could be anywhere in the minute. A line is a duplicate if
+// there's a row for it that an earlier copy in the file hasn't used up.
+func (li *logImporter) add(line importedLine) error {
+	if optedOut(line.nick) {
+		li.report.optedOut++
+		return nil
+	}
+	start, end := line.time.UTC(), line.time.Add(line.precision).UTC()
+	var count int
+	err := li.tx.QueryRow(duplicateQuery, li.channel, line.nick, line.message, start, end, li.lastID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s %d %d %s", line.nick, line.time.Unix(), line.precision, line.message)
+	if li.matched[key] < count {
+		li.matched[key]++
+		li.report.duplicates++
+		return nil
+	}
+	if _, err := li.tx.Exec(importQuery, line.nick, line.nick, line.cmd, li.channel, line.message, start); err != nil {
+		return err
+	}
+	li.report.imported++
+	return nil
+}
+
+// Turn "12:34" or "12:34:56" on the given day into a time, and how
+// precise it is.
+func clockTime(day time.Time, clock string, loc *time.Location) (time.Time, time.Duration, error) {
+	layout, precision := "15:04", time.Minute
+	if len(clock) > 5 {
+		layout, precision = "15:04:05", time.Second
+	}
+	t, err := time.ParseInLocation("2006-01-02 "+layout, day.Format("2006-01-02")+" "+clock, loc)
+	return t, precision, err
+}
+
+func (li *logImporter) importFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	li.tx, err = db.Begin()
+	if err != nil {
+		return err
+	}
+	var day time.Time
+	if match := fileDate.FindStringSubmatch(filepath.Base(filename)); match != nil {
+		day, _ = time.ParseInLocation("20060102", match[1]+match[2]+match[3], li.loc)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		var line *importedLine
+		switch li.format {
+		case "irssi":
+			line, err = li.irssiLine(text, &day)
+		case "znc":
+			line, err = li.zncLine(text, day)
+		case "weechat":
+			line, err = li.weechatLine(text)
+		case "jsonl":
+			line, err = li.jsonLine(text)
+		default:
+			err = fmt.Errorf("unknown format %q", li.format)
+		}
+		switch {
+		case err == errLogEvent:
+			li.report.events++
+		case err == errUnreadable:
+			li.report.skip(filename, lineNumber, text)
+		case err == nil && line != nil:
+			err = li.add(*line)
+		}
+		if err != nil && err != errLogEvent && err != errUnreadable {
+			li.tx.Rollback()
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		li.tx.Rollback()
+		return err
+	}
+	return li.tx.Commit()
+}
+
+// Day changes come back as nil with no error
+func (li *logImporter) irssiLine(text string, day *time.Time) (*importedLine, error) {
+	if match := irssiDay.FindStringSubmatch(text); match != nil {
+		parsed, err := time.ParseInLocation("Jan 2 2006", match[1]+" "+match[2], li.loc)
+		if err != nil {
+			return nil, errUnreadable
+		}
+		*day = parsed
+		return nil, nil
+	}
+	if irssiEvent.MatchString(text) || strings.HasPrefix(text, "--- ") {
+		return nil, errLogEvent
+	}
+	cmd := irc.PRIVMSG
+	match := irssiMessage.FindStringSubmatch(text)
+	if match == nil {
+		cmd = irc.ACTION
+		match = irssiAction.FindStringSubmatch(text)
+	}
+	if match == nil || day.IsZero() {
+		return nil, errUnreadable
+	}
+	t, precision, err := clockTime(*day, match[1], li.loc)
+	if err != nil {
+		return nil, errUnreadable
+	}
+	return &importedLine{strings.TrimSpace(match[2]), cmd, match[3], t, precision}, nil
+}
+
+func (li *logImporter) zncLine(text string, day time.Time) (*importedLine, error) {
+	if zncEvent.MatchString(text) {
+		return nil, errLogEvent
+	}
+	cmd := irc.PRIVMSG
+	match := zncMessage.FindStringSubmatch(text)
+	if match == nil {
+		cmd = irc.ACTION
+		match = zncAction.FindStringSubmatch(text)
+	}
+	if match == nil || day.IsZero() {
+		return nil, errUnreadable
+	}
+	t, precision, err := clockTime(day, match[1], li.loc)
+	if err != nil {
+		return nil, errUnreadable
+	}
+	return &importedLine{match[2], cmd, match[3], t, precision}, nil
+}
+
+// 2014-10-01 12:34:56	@nick	message
+// 2014-10-01 12:34:56	 *	nick waves
+// 2014-10-01 12:34:56	-->	nick (ident@host) has joined #channel
+func (li *logImporter) weechatLine(text string) (*importedLine, error) {
+	splitline := strings.SplitN(text, "\t", 3)
+	if len(splitline) != 3 {
+		return nil, errUnreadable
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", splitline[0], li.loc)
+	if err != nil {
+		return nil, errUnreadable
+	}
+	prefix := strings.TrimSpace(splitline[1])
+	switch prefix {
+	case "-->", "<--", "--", "=!=", "":
+		return nil, errLogEvent
+	case "*":
+		action := strings.SplitN(splitline[2], " ", 2)
+		if len(action) != 2 {
+			return nil, errUnreadable
+		}
+		return &importedLine{action[0], irc.ACTION, action[1], t, time.Second}, nil
+	}
+	return &importedLine{strings.TrimLeft(prefix, "@+%&~"), irc.PRIVMSG, splitline[2], t, time.Second}, nil
+}
+
+// The same lines "sadbot export -format jsonl" writes
+func (li *logImporter) jsonLine(text string) (*importedLine, error) {
+	var line jsonLine
+	if err := json.Unmarshal([]byte(text), &line); err != nil || line.Nick == "" || line.Time.IsZero() {
+		return nil, errUnreadable
+	}
+	if line.Type != irc.PRIVMSG && line.Type != irc.ACTION {
+		return nil, errLogEvent
+	}
+	return &importedLine{line.Nick, line.Type, line.Message, line.Time, time.Second}, nil
+}
+
+// sadbot import -format irssi -channel '#geekhack' -tz America/Chicago ~/irclogs/*.log
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "irssi", "irssi, weechat, znc or jsonl")
+	channel := flags.String("channel", "", "channel the logs are from")
+	tz := flags.String("tz", "", "timezone the logs were written in, defaults to the config's Timezone or UTC")
+	flags.Parse(args)
+
+	if *channel == "" {
+		log.Fatal("-channel is required")
+	}
+	loc, err := exportLocation(*tz)
+	if err != nil {
+		log.Fatal(err)
+	}
+	importer := &logImporter{format: *format, channel: *channel, loc: loc, matched: make(map[string]int)}
+	if err := db.QueryRow(lastMessageQuery).Scan(&importer.lastID); err != nil {
+		log.Fatal(err)
+	}
+	for _, filename := range flags.Args() {
+		log.Printf("Importing %s", filename)
+		if err := importer.importFile(filename); err != nil {
+			log.Fatalf("Error importing %s: %s", filename, err)
+		}
+	}
+
+	report := importer.report
+	log.Printf("Imported %d lines, skipped %d duplicates, %d from opted-out nicks, %d joins/parts/other events"+
+		" and %d lines I couldn't read", report.imported, report.duplicates, report.optedOut, report.events,
+		report.unparsed)
+	for _, example := range report.examples {
+		log.Println("Couldn't read", example)
+	}
+	if report.unparsed > len(report.examples) {
+		log.Printf("...and %d more", report.unparsed-len(report.examples))
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The times the parsers get for 2014-10-01 at some time of day, in UTC
+func importTime(clock string) time.Time {
+	t, _ := time.Parse("2006-01-02 15:04:05", "2014-10-01 "+clock)
+	return t
+}
+
+func TestIrssiLine(t *testing.T) {
+	li := &logImporter{loc: time.UTC}
+	var day time.Time
+	for _, test := range []struct {
+		text string
+		want *importedLine
+		err  error
+	}{
+		{"12:34 <sadbox> before the day", nil, errUnreadable},
+		{"--- Log opened Wed Oct 01 00:00:00 2014", nil, nil},
+		{"12:34 <@sadbox> hello there", &importedLine{"sadbox", "PRIVMSG", "hello there", importTime("12:34:00"), time.Minute}, nil},
+		{"12:34:56 < meeba> hi", &importedLine{"meeba", "PRIVMSG", "hi", importTime("12:34:56"), time.Second}, nil},
+		{"12:35  * sadbox waves", &importedLine{"sadbox", "ACTION", "waves", importTime("12:35:00"), time.Minute}, nil},
+		{"12:36 -!- meeba [~m@host] has joined #geekhack", nil, errLogEvent},
+		{"--- Log closed Wed Oct 01 23:59:59 2014", nil, errLogEvent},
+		{"garbage", nil, errUnreadable},
+	} {
+		got, err := li.irssiLine(test.text, &day)
+		checkImported(t, test.text, got, err, test.want, test.err)
+	}
+	if want := importTime("00:00:00"); !day.Equal(want) {
+		t.Errorf("day = %s, wanted %s", day, want)
+	}
+}
+
+func TestZncLine(t *testing.T) {
+	li := &logImporter{loc: time.UTC}
+	day := importTime("00:00:00")
+	for _, test := range []struct {
+		text string
+		want *importedLine
+		err  error
+	}{
+		{"[12:34:56] <+sadbox> hello", &importedLine{"sadbox", "PRIVMSG", "hello", importTime("12:34:56"), time.Second}, nil},
+		{"[12:34:57] * meeba waves", &importedLine{"meeba", "ACTION", "waves", importTime("12:34:57"), time.Second}, nil},
+		{"[12:35:00] *** Joins: meeba", nil, errLogEvent},
+		{"[99:00:00] <sadbox> hello", nil, errUnreadable},
+		{"hello", nil, errUnreadable},
+	} {
+		got, err := li.zncLine(test.text, day)
+		checkImported(t, test.text, got, err, test.want, test.err)
+	}
+	if _, err := li.zncLine("[12:34:56] <sadbox> hello", time.Time{}); err != errUnreadable {
+		t.Errorf("a line without a day = %v, wanted %v", err, errUnreadable)
+	}
+}
+
+func TestWeechatLine(t *testing.T) {
+	li := &logImporter{loc: time.UTC}
+	for _, test := range []struct {
+		text string
+		want *importedLine
+		err  error
+	}{
+		{"2014-10-01 12:34:56\t@sadbox\thello\tthere", &importedLine{"sadbox", "PRIVMSG", "hello\tthere", importTime("12:34:56"), time.Second}, nil},
+		{"2014-10-01 12:34:57\t *\tmeeba waves", &importedLine{"meeba", "ACTION", "waves", importTime("12:34:57"), time.Second}, nil},
+		{"2014-10-01 12:35:00\t-->\tmeeba (m@host) has joined #geekhack", nil, errLogEvent},
+		{"2014-10-01 12:35:00\t *\tmeeba", nil, errUnreadable},
+		{"yesterday\tsadbox\thello", nil, errUnreadable},
+		{"no tabs", nil, errUnreadable},
+	} {
+		got, err := li.weechatLine(test.text)
+		checkImported(t, test.text, got, err, test.want, test.err)
+	}
+}
+
+func TestJsonLine(t *testing.T) {
+	li := &logImporter{loc: time.UTC}
+	for _, test := range []struct {
+		text string
+		want *importedLine
+		err  error
+	}{
+		{`{"time":"2014-10-01T12:34:56Z","channel":"#geekhack","nick":"sadbox","type":"PRIVMSG","message":"hi"}`,
+			&importedLine{"sadbox", "PRIVMSG", "hi", importTime("12:34:56"), time.Second}, nil},
+		{`{"time":"2014-10-01T12:34:56Z","nick":"meeba","type":"JOIN"}`, nil, errLogEvent},
+		{`{"time":"2014-10-01T12:34:56Z","type":"PRIVMSG","message":"hi"}`, nil, errUnreadable},
+		{`{"nick":"sadbox","type":"PRIVMSG"}`, nil, errUnreadable},
+		{`not json`, nil, errUnreadable},
+	} {
+		got, err := li.jsonLine(test.text)
+		checkImported(t, test.text, got, err, test.want, test.err)
+	}
+}
+
+func checkImported(t *testing.T, text string, got *importedLine, err error, want *importedLine, wantErr error) {
+	if err != wantErr {
+		t.Errorf("%q: error %v, wanted %v", text, err, wantErr)
+		return
+	}
+	if (got == nil) != (want == nil) {
+		t.Errorf("%q = %+v, wanted %+v", text, got, want)
+		return
+	}
+	if got != nil && (got.nick != want.nick || got.cmd != want.cmd || got.message != want.message ||
+		!got.time.Equal(want.time) || got.precision != want.precision) {
+		t.Errorf("%q = %+v, wanted %+v", text, *got, *want)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -39,7 +40,6 @@ var (
 	httpRegex      = regexp.MustCompile(`https?://.*`)
 	findWhiteSpace = regexp.MustCompile(`\s+`)
 	db             *sql.DB
-	badWords       = make(map[string]*regexp.Regexp)
 )
 
 const FREENODE = "irc.freenode.net"
@@ -54,7 +54,6 @@ type Config struct {
 	WolframAPIKey        string
 	OpenWeatherMapAPIKey string
 	IRCPass              string
-	RebuildWords         bool
 	Commands             []struct {
 		Channel  string
 		Commands []struct {
@@ -66,6 +65,140 @@ type Config struct {
 		Word  string
 		Query string
 	}
+	ChannelOptions     []ChannelOptions
+	Admins             []string
+	TitleIgnoreNicks   []string
+	TitleIgnoreDomains []string
+	WebListen          string
+	WebToken           string
+	WebUser            string
+	WebPassword        string
+	// Used for exported logs, UTC if it's not set
+	Timezone string
+	// Messages older than this many days get cleaned up, 0 keeps them forever.
+	// RetentionMode is "purge" to delete them or "anonymise" to strip the
+	// ident and host.
+	RetentionDays int
+	RetentionMode string
+	// Where the channel stats pages get written, and the URL they can
+	// be found at. Pages aren't built without StatsDir.
+	StatsDir string
+	StatsURL string
+	// Where the markov chain is kept between restarts
+	MarkovFile string
+	// How many words the chain looks back (1 to 4) and how many sentences
+	// !chatter says
+	MarkovOrder     int
+	MarkovSentences int
+	// How many nick and channel chains !imitate keeps around
+	MarkovCacheSize int
+	// How many undelivered !tell messages one nick can have, and how many
+	// days they're kept before giving up on them
+	MemoLimit      int
+	MemoExpiryDays int
+	// Nicks or masks (besides the admins) that can !learn and !forget
+	FactoidEditors []string
+}
+
+// Per channel settings, the "default" entry is used for any channel
+// that doesn't have its own.
+type ChannelOptions struct {
+	Channel        string
+	DisableReposts bool
+	DisableTitles  bool
+	// Keep the logs from being shown anywhere outside of the channel
+	Private bool
+	// How likely the bot is to answer when somebody says its nick (0 to
+	// 1), and how many seconds it waits before it'll do it again
+	MentionChance   float64
+	MentionCooldown int
+}
+
+// Things that can be run instead of the bot, like "sadbot export"
+var subcommands = map[string]func(args []string){
+	"export":         exportCommand,
+	"import":         importCommand,
+	"rebuild-markov": rebuildMarkovCommand,
+}
+
+// Tables that are created at startup if they don't exist yet
+var tables = []string{linksTable, titleIgnoreTable, seenTable, optoutTable, wordCountsTable,
+	trackedWordsTable, wordJobsTable, memosTable, remindersTable, karmaTable, factoidsTable,
+	factoidHistoryTable}
+
+func channelOptions(channel string) ChannelOptions {
+	var options ChannelOptions
+	for _, channelConfig := range config.ChannelOptions {
+		if channelConfig.Channel == channel {
+			return channelConfig
+		}
+		if channelConfig.Channel == "default" {
+			options = channelConfig
+		}
+	}
+	return options
+}
+
+// Times go into DATETIME columns as UTC and come back out through
+// UNIX_TIMESTAMP(), which reads them in the session's time zone, so every
+// connection gets told it's in UTC instead of trusting the server default.
+func utcDSN(dsn string) string {
+	if strings.Contains(dsn, "time_zone=") {
+		return dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + "time_zone=" + url.QueryEscape("'+00:00'")
+}
+
+// The name a channel has in the config, whatever case it was typed in.
+// MySQL doesn't care about case when matching it, so nothing else can.
+func configuredChannel(name string) (string, bool) {
+	for _, channel := range config.Channels {
+		if strings.EqualFold(channel, name) {
+			return channel, true
+		}
+	}
+	return "", false
+}
+
+// The "?, ?, ?" for an IN (...) in a query, and the values to go with it
+func sqlList(values []string) (string, []interface{}) {
+	if len(values) == 0 {
+		return "NULL", nil
+	}
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", "), args
+}
+
+// Match a nick or a nick!ident@host mask with * and ? wildcards
+func matchMask(mask string, line *irc.Line) bool {
+	if strings.ContainsAny(mask, "!@") {
+		return wildcardMatch(mask, line.Nick+"!"+line.Ident+"@"+line.Host)
+	}
+	return wildcardMatch(mask, line.Nick)
+}
+
+func wildcardMatch(pattern, s string) bool {
+	quoted := regexp.QuoteMeta(strings.ToLower(pattern))
+	quoted = strings.Replace(quoted, `\*`, `.*`, -1)
+	quoted = strings.Replace(quoted, `\?`, `.`, -1)
+	matched, err := regexp.MatchString("^"+quoted+"$", strings.ToLower(s))
+	return err == nil && matched
+}
+
+func isAdmin(line *irc.Line) bool {
+	for _, admin := range config.Admins {
+		if matchMask(admin, line) {
+			return true
+		}
+	}
+	return false
 }
 
 func getCommand(line *irc.Line) string {
@@ -74,27 +207,146 @@ func getCommand(line *irc.Line) string {
 	return cmd
 }
 
-// Try and grab the title for any URL's posted in the channel
-func sendUrl(channel, unparsedURL string, conn *irc.Conn, nick string) {
-	if !httpRegex.MatchString(unparsedURL) {
-		unparsedURL = `http://` + unparsedURL
+// Rough human readable length of time using the two biggest units, like
+// "3 days, 2 hours". Anything under a minute comes back empty.
+func roughDuration(length time.Duration) string {
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"year", 365 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
 	}
-	postedUrl, err := url.Parse(unparsedURL)
+	var parts []string
+	for _, unit := range units {
+		if length < unit.size {
+			if len(parts) > 0 {
+				break
+			}
+			continue
+		}
+		count := int(length / unit.size)
+		length -= time.Duration(count) * unit.size
+		if count == 1 {
+			parts = append(parts, fmt.Sprintf("1 %s", unit.name))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d %ss", count, unit.name))
+		}
+		if len(parts) == 2 {
+			break
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// How long ago a timestamp was, like "3 days, 2 hours ago"
+func timeAgo(t time.Time) string {
+	ago := roughDuration(time.Since(t))
+	if ago == "" {
+		return "just now"
+	}
+	return ago + " ago"
+}
+
+// How long until a timestamp, like "in 3 days, 2 hours"
+func timeUntil(t time.Time) string {
+	until := roughDuration(t.Sub(time.Now()))
+	if until == "" {
+		return "any second now"
+	}
+	return "in " + until
+}
+
+var relativeTime = regexp.MustCompile(`^(\d+)([wd])$`)
+
+// Parse the times used in search filters, either relative ("7d", "2w",
+// "3h30m") which counts back from now or a date ("2014-10-01").
+func parseTimeArg(arg string) (time.Time, error) {
+	return parseTimeArgIn(arg, time.UTC)
+}
+
+// Same as parseTimeArg, with dates starting at midnight in loc
+func parseTimeArgIn(arg string, loc *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", arg, loc); err == nil {
+		return t, nil
+	}
+	if match := relativeTime.FindStringSubmatch(arg); match != nil {
+		count, err := strconv.Atoi(match[1])
+		if err != nil {
+			return time.Time{}, err
+		}
+		days := count
+		if match[2] == "w" {
+			days = count * 7
+		}
+		return time.Now().AddDate(0, 0, -days), nil
+	}
+	duration, err := time.ParseDuration(arg)
 	if err != nil {
-		log.Println(err)
+		return time.Time{}, fmt.Errorf("I don't understand the time %q", arg)
+	}
+	return time.Now().Add(-duration), nil
+}
+
+// Try and grab the title for any URL's posted in the channel. firstPost is
+// whoever posted it in the channel first, nil if nobody has.
+func sendUrl(job urlJob, firstPost *linkPost, title string, hops []redirectHop) {
+	finalUrl := job.url
+	if len(hops) > 0 {
+		finalUrl = hops[len(hops)-1].URL
+		if titleIgnored(domainKind, finalUrl.Host) {
+			log.Println("Not showing title for link redirecting to ignored domain " + finalUrl.Host)
+			title = ""
+		}
+	}
+
+	// Opted-out nicks don't get their links kept either
+	if firstPost == nil && !optedOut(job.nick) {
+		err := recordLink(job.channel, job.nick, job.url, title)
+		if err != nil {
+			log.Println("Error recording link:", err)
+		}
+	}
+
+	if title == "" {
+		return
+	}
+	if job.expired() {
+		log.Println("Too late to send the title for " + job.url.String() + " to " + job.channel)
 		return
 	}
-	log.Println("Fetching title for " + postedUrl.String() + " In channel " + channel)
+	// Example:
+	// Title: sadbox . org (at sadbox.org)
+	hostNick := fmt.Sprintf(" (%s)", describeRedirect(job.url, finalUrl))
+	if firstPost != nil && !channelOptions(job.channel).DisableReposts {
+		if optedOut(firstPost.Nick) {
+			hostNick += fmt.Sprintf(" [Old! Posted %s]", timeAgo(firstPost.Time))
+		} else {
+			hostNick += fmt.Sprintf(" [Old! Posted by %s %s]", firstPost.Nick, timeAgo(firstPost.Time))
+		}
+	}
+	formattedTitle := html.UnescapeString(title)
+	formattedTitle = findWhiteSpace.ReplaceAllString(formattedTitle, " ")
+	if len(formattedTitle) > job.conn.Config().SplitLen-len(hostNick)-1 {
+		formattedTitle = formattedTitle[:job.conn.Config().SplitLen-len(hostNick)-1]
+	}
+	formattedTitle = formattedTitle + hostNick
+	log.Println(formattedTitle)
+	job.conn.Privmsg(job.channel, formattedTitle)
+}
 
-	resp, err := http.Get(postedUrl.String())
+// Fetch the <title> of an HTML page, returns "" for anything that isn't HTML.
+// The redirects it went through on the way are returned too.
+func fetchTitle(postedUrl *url.URL) (string, []redirectHop, error) {
+	resp, hops, err := getFollowingRedirects(postedUrl)
 	if err != nil {
-		log.Println(err)
-		return
+		return "", hops, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		log.Println("http server return error.")
-		return
+		return "", hops, fmt.Errorf("http server returned %s", resp.Status)
 	}
 	respbody := []byte{}
 	if resp.Header.Get("Content-Type") == "" {
@@ -109,58 +361,61 @@ func sendUrl(channel, unparsedURL string, conn *irc.Conn, nick string) {
 
 	if !strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
 		log.Println("content-type is not text/html")
-		return
+		return "", hops, nil
 	}
 
 	utf8Body, err := charset.NewReader(resp.Body, resp.Header.Get("Content-Type"))
 	if err != nil {
-		log.Println("Error converting page to utf8:", err)
-		return
+		return "", hops, fmt.Errorf("Error converting page to utf8: %s", err)
 	}
 	restofbody, err := ioutil.ReadAll(io.LimitReader(utf8Body, 50000))
 	if err != nil {
-		log.Println("Error reading posted link:", err)
-		return
+		return "", hops, fmt.Errorf("Error reading posted link: %s", err)
 	}
 	respbody = append(respbody, restofbody...)
 	query, err := goquery.NewDocumentFromReader(bytes.NewReader(respbody))
 	if err != nil {
-		log.Println("Error parsing HTML tree:", err)
-		return
+		return "", hops, fmt.Errorf("Error parsing HTML tree: %s", err)
 	}
 	title := query.Find("title").Text()
 	title = strings.TrimSpace(title)
 	if len(title) == 0 || !utf8.ValidString(title) {
-		return
+		return "", hops, nil
 	}
-	// Example:
-	// Title: sadbox . org (at sadbox.org)
-	hostNick := fmt.Sprintf(" (%s)", postedUrl.Host)
-	formattedTitle := html.UnescapeString(title)
-	formattedTitle = findWhiteSpace.ReplaceAllString(formattedTitle, " ")
-	if len(formattedTitle) > conn.Config().SplitLen-len(hostNick)-1 {
-		formattedTitle = formattedTitle[:conn.Config().SplitLen-len(hostNick)-1]
-	}
-	formattedTitle = formattedTitle + hostNick
-	log.Println(formattedTitle)
-	conn.Privmsg(channel, formattedTitle)
+	return title, hops, nil
 }
 
 func logMessage(conn *irc.Conn, line *irc.Line) {
-	_, err := db.Exec("insert into messages (Nick, Ident, Host, Src, Cmd, Channel,"+
-		" Message, Time) values (?, ?, ?, ?, ?, ?, ?, ?)", line.Nick, line.Ident,
-		line.Host, line.Src, line.Cmd, line.Target(), line.Text(), line.Time)
+	if optedOut(line.Nick) {
+		return
+	}
+	id, err := insertMessage(line, line.Target(), line.Text())
 	if err != nil {
 		log.Println(err)
 	}
-	err = updateWords(line.Nick, line.Text())
+	// Private messages to the bot aren't anybody's business
+	if strings.HasPrefix(line.Target(), "#") {
+		if err := updateSeen(line, line.Target(), line.Text()); err != nil {
+			log.Println(err)
+		}
+	}
+	err = updateWords(id, line.Nick, line.Target(), line.Text(), line.Time)
 	if err != nil {
 		log.Println(err)
 	}
+	if markovChannel(line.Target()) {
+		markovData.Add(line.Text())
+	}
+	learnModels(line.Nick, line.Target(), line.Text())
 }
 
+// Titles can be skipped for a line by starting it with # or putting
+// [nt] anywhere in it.
 func checkForUrl(conn *irc.Conn, line *irc.Line) {
-	if strings.HasPrefix(line.Text(), "#") {
+	if strings.HasPrefix(line.Text(), "#") || strings.Contains(line.Text(), "[nt]") {
+		return
+	}
+	if !titlesWanted(line) {
 		return
 	}
 	urllist := make(map[string]struct{})
@@ -173,7 +428,7 @@ func checkForUrl(conn *irc.Conn, line *irc.Line) {
 		if numlinks > 3 {
 			break
 		}
-		go sendUrl(line.Target(), item, conn, line.Nick)
+		queueUrl(conn, line.Target(), item, line.Nick)
 	}
 }
 
@@ -184,33 +439,13 @@ func cst(conn *irc.Conn, line *irc.Line) {
 	go conn.Privmsg(line.Target(), "\u00039,13#CSTMASTERRACE")
 }
 
-// Commands that are read in from the config file
-func configCommands(conn *irc.Conn, line *irc.Line) {
-	splitmessage := strings.Split(line.Text(), " ")
-AllConfigs:
-	for _, commandConfig := range config.Commands {
-		if commandConfig.Channel == line.Target() || commandConfig.Channel == "default" {
-			for _, command := range commandConfig.Commands {
-				if getCommand(line) == command.Name {
-					var response string
-					if len(splitmessage) >= 2 {
-						response = fmt.Sprintf("%s: %s", splitmessage[1], command.Text)
-					} else {
-						response = command.Text
-					}
-					go conn.Privmsg(line.Target(), response)
-					break AllConfigs
-				}
-			}
-		}
-	}
+func init() {
+	rand.Seed(time.Now().UTC().UnixNano())
 }
 
-func init() {
+func loadConfig() {
 	log.Println("Starting sadbot")
 
-	rand.Seed(time.Now().UTC().UnixNano())
-
 	configfile, err := os.Open("config.json")
 	if err != nil {
 		log.Fatal(err)
@@ -220,10 +455,6 @@ func init() {
 		log.Fatal(err)
 	}
 
-	for _, word := range config.BadWords {
-		badWords[word.Word] = regexp.MustCompile(word.Query)
-	}
-
 	log.Println("Loaded config file!")
 	log.Printf("Joining: %s", config.Channels)
 	log.Printf("Nick: %s", config.Nick)
@@ -243,8 +474,9 @@ func init() {
 func main() {
 	//flag.Parse()
 	//glog.Init()
+	loadConfig()
 	var err error
-	db, err = sql.Open("mysql", config.DBConn)
+	db, err = sql.Open("mysql", utcDSN(config.DBConn))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -252,13 +484,49 @@ func main() {
 	db.SetMaxIdleConns(100)
 	db.SetMaxOpenConns(200)
 
+	for _, table := range tables {
+		if _, err := db.Exec(table); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// The subcommands need these too, import mustn't bring anybody back
+	loadOptouts()
+	if len(os.Args) > 1 {
+		subcommand, ok := subcommands[os.Args[1]]
+		if !ok {
+			log.Fatalf("Unknown command %s", os.Args[1])
+		}
+		subcommand(os.Args[2:])
+		return
+	}
+
+	loadTitleIgnores()
+	loadTrackedWords()
+	loadMemoRecipients()
+	loadConfigFactoids()
+	if config.RetentionDays > 0 {
+		go retention()
+	}
+	go expireMemos()
+	startUrlWorkers()
+	go addGrepIndex()
+	if config.StatsDir != "" {
+		go buildStatsPages()
+	}
+	if config.WebListen != "" {
+		go startWeb()
+	}
+
+	markovData.Init(markovOrder())
 	go makeMarkov()
 
 	buildchan := make(chan os.Signal, 1)
 	signal.Notify(buildchan, syscall.SIGUSR1)
 	go func() {
 		for _ = range buildchan {
-			genTables()
+			if err := genTables(""); err != nil {
+				log.Println("Error starting the word recount:", err)
+			}
 		}
 	}()
 
@@ -277,6 +545,8 @@ func main() {
 				conn.Join(channel)
 			}
 			log.Println("Connected!")
+			go wordJobWorker(conn)
+			go reminderWorker(conn)
 		})
 	quit := make(chan bool)
 
@@ -286,6 +556,10 @@ func main() {
 	// Handle all the things
 	c.HandleFunc(irc.PRIVMSG, logMessage)
 	c.HandleFunc(irc.ACTION, logMessage)
+	for _, event := range channelEvents {
+		c.HandleFunc(event, logEvent)
+	}
+	c.HandleFunc("353", trackNames)
 
 	c.HandleFunc(irc.PRIVMSG, checkForUrl)
 	c.HandleFunc(irc.ACTION, checkForUrl)
@@ -294,17 +568,39 @@ func main() {
 	c.HandleFunc(irc.PRIVMSG, wolfram)
 	c.HandleFunc(irc.PRIVMSG, meeba)
 	c.HandleFunc(irc.PRIVMSG, markov)
+	c.HandleFunc(irc.PRIVMSG, mentionReply)
+	c.HandleFunc(irc.PRIVMSG, imitate)
 	c.HandleFunc(irc.PRIVMSG, dance)
 	c.HandleFunc(irc.PRIVMSG, cst)
 	c.HandleFunc(irc.PRIVMSG, roll)
 	c.HandleFunc(irc.PRIVMSG, btc)
 	c.HandleFunc(irc.PRIVMSG, lastSeen)
+	c.HandleFunc(irc.PRIVMSG, showSeen)
+	c.HandleFunc(irc.PRIVMSG, privacy)
+	c.HandleFunc(irc.PRIVMSG, redact)
 	c.HandleFunc(irc.PRIVMSG, showWeather)
 	c.HandleFunc(irc.PRIVMSG, showQuote)
-	c.HandleFunc(irc.PRIVMSG, configCommands)
+	c.HandleFunc(irc.PRIVMSG, searchLinks)
+	c.HandleFunc(irc.PRIVMSG, more)
+	c.HandleFunc(irc.PRIVMSG, titleSettings)
+	c.HandleFunc(irc.PRIVMSG, expand)
+	c.HandleFunc(irc.PRIVMSG, grepLogs)
+	c.HandleFunc(irc.PRIVMSG, showStats)
+	c.HandleFunc(irc.PRIVMSG, showWords)
+	c.HandleFunc(irc.PRIVMSG, factoids)
+	c.HandleFunc(irc.PRIVMSG, learn)
+	c.HandleFunc(irc.PRIVMSG, forget)
+	c.HandleFunc(irc.PRIVMSG, info)
+	c.HandleFunc(irc.PRIVMSG, tell)
+	c.HandleFunc(irc.PRIVMSG, remind)
+	c.HandleFunc(irc.PRIVMSG, karma)
+	c.HandleFunc(irc.PRIVMSG, showKarma)
+	c.HandleFunc(irc.PRIVMSG, tellOnMessage)
+	c.HandleFunc(irc.ACTION, tellOnMessage)
+	c.HandleFunc(irc.JOIN, tellOnJoin)
 
 	if err := c.Connect(); err != nil {
-		log.Fatalln("Connection error: %s\n", err)
+		log.Fatalln("Connection error:", err)
 	}
 
 	<-quit
@@ -0,0 +1,53 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeArg(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		arg  string
+		want time.Time
+		ok   bool
+	}{
+		{"2014-10-01", time.Date(2014, 10, 1, 0, 0, 0, 0, time.UTC), true},
+		{"7d", now.AddDate(0, 0, -7), true},
+		{"2w", now.AddDate(0, 0, -14), true},
+		{"3h30m", now.Add(-3*time.Hour - 30*time.Minute), true},
+		{"90s", now.Add(-90 * time.Second), true},
+		{"2014-13-01", time.Time{}, false},
+		{"yesterday", time.Time{}, false},
+		{"7y", time.Time{}, false},
+		{"", time.Time{}, false},
+	} {
+		got, err := parseTimeArg(test.arg)
+		if (err == nil) != test.ok {
+			t.Errorf("parseTimeArg(%q) = %v, wanted ok %t", test.arg, err, test.ok)
+			continue
+		}
+		// Relative times count back from whenever they were parsed
+		if diff := got.Sub(test.want); diff < -time.Minute || diff > time.Minute {
+			t.Errorf("parseTimeArg(%q) = %s, wanted %s", test.arg, got, test.want)
+		}
+	}
+}
+
+func TestParseTimeArgIn(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Skip("no timezone data:", err)
+	}
+	got, err := parseTimeArgIn("2014-10-01", chicago)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2014, 10, 1, 5, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("2014-10-01 in Chicago = %s, wanted %s", got.UTC(), want)
+	}
+}
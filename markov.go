@@ -5,11 +5,17 @@
 package main
 
 import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"sort"
 	"strings"
 	"sync"
-	"unicode"
+	"time"
 
 	irc "github.com/fluffle/goirc/client"
 	_ "github.com/go-sql-driver/mysql"
@@ -19,25 +25,439 @@ var markovData Markov
 
 const PUNCTUATION = `!"#$%&\'()*+,-./:;<=>?@[\\]^_{|}~` + "`"
 
+const (
+	markovBatchQuery = `SELECT ID, Message FROM messages WHERE ID > ? AND Channel IN (%s) ` +
+		`AND Cmd IN ('PRIVMSG', 'ACTION') AND ` + notOptedOut + ` ORDER BY ID LIMIT ?;`
+	markovNickQuery = `SELECT Message FROM messages WHERE Nick = ? AND Channel IN (%s) ` +
+		`AND Cmd IN ('PRIVMSG', 'ACTION');`
+	markovBatch = 10000
+	// How often new lines get written out to the markov file
+	markovSaveEvery = 10 * time.Minute
+	// Sentences that go on longer than this get cut off
+	maxSentenceWords = 60
+)
+
+// Words are stored as IDs into Markov.words. The first few are special:
+// nothing (for the unused end of a key), and the start and end of a line.
+const (
+	noWord = iota
+	startWord
+	endWord
+	firstWord
+)
+
+// The IDs of the words before the next one. Orders below 4 leave the
+// end of it empty.
+type markovKey [4]uint32
+
+// A word that has come after a key, and how many times it has
+type successor struct {
+	Word  uint32
+	Count uint32
+}
+
+// Everything that has come after a key. Most keys only ever have one
+// or two, so the total is worked out when it's needed rather than kept.
+type successors []successor
+
+func (s successors) add(word uint32) successors {
+	for i := range s {
+		if s[i].Word == word {
+			s[i].Count++
+			return s
+		}
+	}
+	return append(s, successor{word, 1})
+}
+
+// Take one away from a word, dropping it once it's at 0. false if the
+// word was never there.
+func (s successors) remove(word uint32) (successors, bool) {
+	for i := range s {
+		if s[i].Word == word {
+			if s[i].Count > 1 {
+				s[i].Count--
+				return s, true
+			}
+			return append(s[:i], s[i+1:]...), true
+		}
+	}
+	return s, false
+}
+
+func setSuccessors(chain map[markovKey]successors, key markovKey, s successors) {
+	if len(s) == 0 {
+		delete(chain, key)
+		return
+	}
+	chain[key] = s
+}
+
+// Pick one, weighted by how often each has come up
+func (s successors) pick() uint32 {
+	var total int64
+	for _, word := range s {
+		total += int64(word.Count)
+	}
+	if total == 0 {
+		return noWord
+	}
+	n := uint32(rand.Int63n(total))
+	for _, word := range s {
+		if n < word.Count {
+			return word.Word
+		}
+		n -= word.Count
+	}
+	return noWord
+}
+
 type Markov struct {
-	mutex  sync.RWMutex
-	keys   []string
-	bigmap map[string][]string
+	mutex sync.RWMutex
+	// How many words of context pick the next one
+	order int
+	// Every word the chain knows about, by ID, and the other way around
+	words []string
+	ids   map[string]uint32
+	// How many times each word comes up in the chain, so words that
+	// have been unlearned everywhere can be blanked out
+	uses []uint32
+	// What comes after each key, and what comes before it
+	forward  map[markovKey]successors
+	backward map[markovKey]successors
+	// Whether there's anything that hasn't been saved yet
+	dirty bool
+}
+
+// What goes in the markov file. The maps are flattened out into lists
+// of keys and what follows them.
+type markovSave struct {
+	Order        int
+	Words        []string
+	ForwardKeys  []markovKey
+	Forward      []successors
+	BackwardKeys []markovKey
+	Backward     []successors
+}
+
+var errMarkovStale = errors.New("the markov file is from an older version or a different order")
+
+func (m *Markov) Init(order int) {
+	m.order = order
+	m.words = []string{"", "", ""}
+	m.ids = make(map[string]uint32)
+	m.uses = make([]uint32, firstWord)
+	m.forward = make(map[markovKey]successors)
+	m.backward = make(map[markovKey]successors)
+}
+
+// The ID for a word, making a new one if it hasn't been seen before
+func (m *Markov) intern(word string) uint32 {
+	if id, ok := m.ids[word]; ok {
+		return id
+	}
+	id := uint32(len(m.words))
+	m.words = append(m.words, word)
+	m.uses = append(m.uses, 0)
+	m.ids[word] = id
+	return id
+}
+
+// One less use of a word, blanking it out if that was the last
+func (m *Markov) unuse(id uint32) {
+	if id < firstWord || m.uses[id] == 0 {
+		return
+	}
+	m.uses[id]--
+	if m.uses[id] == 0 {
+		delete(m.ids, m.words[id])
+		m.words[id] = ""
+	}
+}
+
+func (m *Markov) key(ids []uint32) markovKey {
+	var key markovKey
+	copy(key[:], ids)
+	return key
+}
+
+// The first state of every sentence
+func (m *Markov) start() []uint32 {
+	state := make([]uint32, m.order)
+	for i := range state {
+		state[i] = startWord
+	}
+	return state
+}
+
+func (m *Markov) text(ids []uint32) string {
+	words := make([]string, len(ids))
+	for i, id := range ids {
+		words[i] = m.words[id]
+	}
+	return strings.Join(words, " ")
+}
+
+// Learn from one line, which is taken to be one sentence. Punctuation
+// and casing are kept as they are.
+func (m *Markov) Add(message string) {
+	words := strings.Fields(message)
+	if len(words) == 0 {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	chain := m.start()
+	for _, word := range words {
+		chain = append(chain, m.intern(word))
+	}
+	chain = append(chain, endWord)
+	for position := 0; position+m.order < len(chain); position++ {
+		key := m.key(chain[position : position+m.order])
+		m.forward[key] = m.forward[key].add(chain[position+m.order])
+		m.uses[chain[position+m.order]]++
+		backkey := m.key(chain[position+1 : position+1+m.order])
+		m.backward[backkey] = m.backward[backkey].add(chain[position])
+	}
+	m.dirty = true
+}
+
+// Unlearn a line that Add learned, for lines that are redacted, purged
+// or opted out. Anything it never learned is left alone.
+func (m *Markov) Remove(message string) {
+	words := strings.Fields(message)
+	if len(words) == 0 {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	chain := m.start()
+	for _, word := range words {
+		id, ok := m.ids[word]
+		if !ok {
+			return
+		}
+		chain = append(chain, id)
+	}
+	chain = append(chain, endWord)
+	for position := 0; position+m.order < len(chain); position++ {
+		key := m.key(chain[position : position+m.order])
+		if next, ok := m.forward[key].remove(chain[position+m.order]); ok {
+			setSuccessors(m.forward, key, next)
+			m.unuse(chain[position+m.order])
+		}
+		backkey := m.key(chain[position+1 : position+1+m.order])
+		if previous, ok := m.backward[backkey].remove(chain[position]); ok {
+			setSuccessors(m.backward, backkey, previous)
+		}
+	}
+	m.dirty = true
+}
+
+// Make up some sentences
+func (m *Markov) Generate(sentences int) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var result []string
+	for i := 0; i < sentences; i++ {
+		if ids := m.forwards(m.start()); len(ids) > 0 {
+			result = append(result, m.text(ids))
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+// Make up a sentence with the seed words in it, working backwards from
+// the start of the seed and forwards from the end. Returns "" if the
+// chain hasn't seen any of it.
+func (m *Markov) GenerateFrom(seed []string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	size := len(seed)
+	if size > m.order {
+		size = m.order
+	}
+	before := m.findKey(m.backward, seed[:size], false)
+	after := m.findKey(m.forward, seed[len(seed)-size:], true)
+	if before == nil && after == nil {
+		return ""
+	}
+	var words []string
+	if before != nil {
+		words = append(words, m.text(m.backwards(before)))
+	}
+	words = append(words, seed...)
+	if after != nil {
+		words = append(words, m.text(m.forwards(after)))
+	}
+	return strings.TrimSpace(strings.Join(words, " "))
 }
 
-func (m *Markov) Init() {
-	m.bigmap = make(map[string][]string)
+// Carry on from some state until a sentence ends
+func (m *Markov) forwards(state []uint32) []uint32 {
+	var ids []uint32
+	for len(ids) < maxSentenceWords {
+		next := m.forward[m.key(state)].pick()
+		if next == noWord || next == endWord {
+			break
+		}
+		ids = append(ids, next)
+		state = append(state[1:], next)
+	}
+	return ids
 }
 
-func cleanspaces(message string) []string {
-	splitmessage := strings.Split(message, " ")
-	var newslice []string
-	for _, word := range splitmessage {
-		if strings.TrimSpace(word) != "" {
-			newslice = append(newslice, removeChars(strings.TrimSpace(word), PUNCTUATION))
+// Work back from some state until a sentence starts
+func (m *Markov) backwards(state []uint32) []uint32 {
+	var ids []uint32
+	for len(ids) < maxSentenceWords {
+		previous := m.backward[m.key(state)].pick()
+		if previous == noWord || previous == startWord {
+			break
 		}
+		ids = append([]uint32{previous}, ids...)
+		state = append([]uint32{previous}, state[:len(state)-1]...)
 	}
-	return newslice
+	return ids
+}
+
+// Pick a random key that ends with the seed (or starts with it, for
+// the backwards chain), ignoring case. This looks through every key,
+// which is fine for the odd command.
+func (m *Markov) findKey(chain map[markovKey]successors, seed []string, atEnd bool) []uint32 {
+	// Every ID that could stand in for each word of the seed, so "cats"
+	// finds "Cats" and "cats."
+	matching := make([][]bool, len(seed))
+	for i, word := range seed {
+		matching[i] = make([]bool, len(m.words))
+		word = strings.TrimRight(word, ".,!?;:")
+		found := false
+		for id, known := range m.words[firstWord:] {
+			if strings.EqualFold(strings.TrimRight(known, ".,!?;:"), word) {
+				matching[i][id+firstWord] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	offset := 0
+	if atEnd {
+		offset = m.order - len(seed)
+	}
+	var found markovKey
+	matches := 0
+keys:
+	for key := range chain {
+		for i := range seed {
+			if !matching[i][key[offset+i]] {
+				continue keys
+			}
+		}
+		matches++
+		if rand.Intn(matches) == 0 {
+			found = key
+		}
+	}
+	if matches == 0 {
+		return nil
+	}
+	return append([]uint32(nil), found[:m.order]...)
+}
+
+func flatten(chain map[markovKey]successors) ([]markovKey, []successors) {
+	keys := make([]markovKey, 0, len(chain))
+	words := make([]successors, 0, len(chain))
+	for key, next := range chain {
+		keys = append(keys, key)
+		words = append(words, next)
+	}
+	return keys, words
+}
+
+func unflatten(keys []markovKey, words []successors) map[markovKey]successors {
+	chain := make(map[markovKey]successors, len(keys))
+	for i, key := range keys {
+		chain[key] = words[i]
+	}
+	return chain
+}
+
+// Write the chain out as gzipped gob, going through a temporary file so
+// a crash halfway through doesn't lose the old one.
+func (m *Markov) Save(filename string) error {
+	m.mutex.Lock()
+	m.dirty = false
+	m.mutex.Unlock()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	saved := markovSave{Order: m.order, Words: m.words}
+	saved.ForwardKeys, saved.Forward = flatten(m.forward)
+	saved.BackwardKeys, saved.Backward = flatten(m.backward)
+
+	file, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	zipper := gzip.NewWriter(file)
+	if err := gob.NewEncoder(zipper).Encode(saved); err != nil {
+		file.Close()
+		return err
+	}
+	if err := zipper.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func (m *Markov) Load(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	unzipper, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	var saved markovSave
+	if err := gob.NewDecoder(unzipper).Decode(&saved); err != nil {
+		log.Println("Error reading markov data:", err)
+		return errMarkovStale
+	}
+	if saved.Order != m.order || len(saved.Words) < firstWord ||
+		len(saved.ForwardKeys) != len(saved.Forward) || len(saved.BackwardKeys) != len(saved.Backward) {
+		return errMarkovStale
+	}
+	// Blanked out words are left out, nothing refers to them
+	ids := make(map[string]uint32, len(saved.Words))
+	for id, word := range saved.Words[firstWord:] {
+		if word != "" {
+			ids[word] = uint32(id + firstWord)
+		}
+	}
+	uses := make([]uint32, len(saved.Words))
+	for _, next := range saved.Forward {
+		for _, word := range next {
+			if int(word.Word) >= len(uses) {
+				return errMarkovStale
+			}
+			uses[word.Word] += word.Count
+		}
+	}
+	forward := unflatten(saved.ForwardKeys, saved.Forward)
+	backward := unflatten(saved.BackwardKeys, saved.Backward)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.words, m.ids, m.uses = saved.Words, ids, uses
+	m.forward, m.backward = forward, backward
+	return nil
 }
 
 func removeChars(bigstring, removeset string) string {
@@ -47,70 +467,239 @@ func removeChars(bigstring, removeset string) string {
 	return bigstring
 }
 
-// This is what generates the actual markov chain
+// This is what generates the actual markov chain. !chatter makes
+// something up, !chatter cats (or !chatter about cats) makes something
+// up about cats.
 func markov(conn *irc.Conn, line *irc.Line) {
 	if line.Nick != "sadbox" || getCommand(line) != "!chatter" {
 		return
 	}
-	markovData.mutex.RLock()
-	var markovchain string
-	messageLength := rand.Intn(50) + 10
-	for i := 0; i < messageLength; i++ {
-		splitchain := strings.Split(markovchain, " ")
-		if len(splitchain) < 2 {
-			s := []rune(markovData.keys[rand.Intn(len(markovData.keys))])
-			s[0] = unicode.ToUpper(s[0])
-			markovchain = string(s)
-			continue
-		}
-		chainlength := len(splitchain)
-		searchfor := strings.ToLower(splitchain[chainlength-2] + " " + splitchain[chainlength-1])
-		if len(markovData.bigmap[searchfor]) == 0 || strings.LastIndex(markovchain, ".") < len(markovchain)-50 {
-			s := []rune(markovData.keys[rand.Intn(len(markovData.keys))])
-			s[0] = unicode.ToUpper(s[0])
-			markovchain = markovchain + ". " + string(s)
-			continue
-		}
-		randnext := rand.Intn(len(markovData.bigmap[searchfor]))
-		markovchain = markovchain + " " + markovData.bigmap[searchfor][randnext]
-	}
-	conn.Privmsg(line.Target(), markovchain+".")
-	markovData.mutex.RUnlock()
-}
-
-// Build the whole markov chain.. this sits in memory, so adjust the limit and junk
-func makeMarkov() {
-	rows, err := db.Query(`SELECT Message from messages where Channel = '#geekhack' order by RAND() limit 30000`)
+	seed := strings.Fields(line.Text())[1:]
+	if len(seed) > 1 && seed[0] == "about" {
+		seed = seed[1:]
+	}
+	if len(seed) == 0 {
+		if chatter := markovData.Generate(markovSentences()); chatter != "" {
+			conn.Privmsg(line.Target(), chatter)
+		}
+		return
+	}
+	chatter := markovData.GenerateFrom(seed)
+	if chatter == "" {
+		chatter = fmt.Sprintf("%s: I don't know anything about %s.", line.Nick, strings.Join(seed, " "))
+	}
+	conn.Privmsg(line.Target(), chatter)
+}
+
+// When chatter last answered somebody in each channel
+var mentions = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// Whether a line says the bot's nick
+func mentioned(conn *irc.Conn, line *irc.Line) bool {
+	for _, word := range strings.Fields(line.Text()) {
+		if strings.EqualFold(strings.Trim(word, ":,.!?@"), conn.Me().Nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer people talking to the bot with some chatter, sometimes. How
+// often is up to MentionChance and MentionCooldown in the channel's
+// options.
+func mentionReply(conn *irc.Conn, line *irc.Line) {
+	options := channelOptions(line.Target())
+	if options.MentionChance <= 0 || strings.HasPrefix(line.Text(), "!") || !mentioned(conn, line) {
+		return
+	}
+	mentions.Lock()
+	cooldown := time.Duration(options.MentionCooldown) * time.Second
+	if time.Since(mentions.last[line.Target()]) < cooldown || rand.Float64() >= options.MentionChance {
+		mentions.Unlock()
+		return
+	}
+	mentions.last[line.Target()] = time.Now()
+	mentions.Unlock()
+
+	// Try to say something about what they said, longest words first
+	var words []string
+	for _, word := range strings.Fields(line.Text()) {
+		word = strings.Trim(word, ":,.!?@")
+		if len(word) > 2 && !strings.EqualFold(word, conn.Me().Nick) {
+			words = append(words, word)
+		}
+	}
+	sort.SliceStable(words, func(i, j int) bool { return len(words[i]) > len(words[j]) })
+	for _, word := range words {
+		if chatter := markovData.GenerateFrom([]string{word}); chatter != "" {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, chatter))
+			return
+		}
+	}
+	if chatter := markovData.Generate(1); chatter != "" {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, chatter))
+	}
+}
+
+// Whether a line should go into the markov chain. Private channels are
+// left out so chatter can't repeat them anywhere else.
+func markovChannel(channel string) bool {
+	for _, public := range webChannels() {
+		if public == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkovOrder is clamped to 1-4, it's 2 if it isn't set
+func markovOrder() int {
+	switch {
+	case config.MarkovOrder < 1:
+		return 2
+	case config.MarkovOrder > 4:
+		return 4
+	}
+	return config.MarkovOrder
+}
+
+func markovSentences() int {
+	if config.MarkovSentences < 1 {
+		return 2
+	}
+	return config.MarkovSentences
+}
+
+func markovFile() string {
+	if config.MarkovFile == "" {
+		return "markov.gob.gz"
+	}
+	return config.MarkovFile
+}
+
+// Train a chain on everything that's been logged, a batch at a time
+func trainMarkov(m *Markov) error {
+	list, channels := sqlList(webChannels())
+	query := fmt.Sprintf(markovBatchQuery, list)
+	var lastID int64
+	lines := 0
+	for {
+		rows, err := db.Query(query, append(append([]interface{}{lastID}, channels...), markovBatch)...)
+		if err != nil {
+			return err
+		}
+		seen := 0
+		for rows.Next() {
+			var message string
+			if err := rows.Scan(&lastID, &message); err != nil {
+				rows.Close()
+				return err
+			}
+			m.Add(message)
+			seen++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if seen == 0 {
+			break
+		}
+		lines += seen
+		log.Printf("Trained markov on %d lines", lines)
+	}
+	return nil
+}
+
+// Unlearn or relearn a line from the logs, if it's one the chain would
+// have learned from
+func markovLine(channel, nick, cmd, message string, learn bool) {
+	if !markovChannel(channel) || (cmd != "PRIVMSG" && cmd != "ACTION") || optedOut(nick) {
+		return
+	}
+	if learn {
+		markovData.Add(message)
+	} else {
+		markovData.Remove(message)
+	}
+}
+
+// Take everything a nick has said out of the chain when they opt out,
+// or put it back when they opt in again
+func markovNick(nick string, learn bool) {
+	list, channels := sqlList(webChannels())
+	args := append([]interface{}{nick}, channels...)
+	rows, err := db.Query(fmt.Sprintf(markovNickQuery, list), args...)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Error fetching lines for markov:", err)
+		return
 	}
+	defer rows.Close()
+	lines := 0
 	for rows.Next() {
 		var message string
 		if err := rows.Scan(&message); err != nil {
-			log.Fatal(err)
-		}
-		message = strings.ToLower(message)
-		newslice := cleanspaces(message)
-		splitlength := len(newslice)
-		for position, word := range newslice {
-			if splitlength-2 <= position {
-				break
-			}
-			wordkey := word + " " + newslice[position+1]
-			markovData.bigmap[wordkey] = append(markovData.bigmap[wordkey], newslice[position+2])
+			log.Println("Error fetching lines for markov:", err)
+			return
+		}
+		if learn {
+			markovData.Add(message)
+		} else {
+			markovData.Remove(message)
 		}
+		lines++
 	}
 	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+		log.Println("Error fetching lines for markov:", err)
+	}
+	verb := "Unlearned"
+	if learn {
+		verb = "Relearned"
 	}
-	for key, _ := range markovData.bigmap {
-		markovData.keys = append(markovData.keys, key)
+	log.Printf("%s %d markov lines from %s", verb, lines, nick)
+}
+
+// Load the chain from disk, or build it from scratch if there isn't
+// one yet, then keep saving it as it learns.
+func makeMarkov() {
+	err := markovData.Load(markovFile())
+	switch {
+	case os.IsNotExist(err), err == errMarkovStale:
+		log.Printf("No order %d markov data in %s yet, training on the logs", markovOrder(), markovFile())
+		if err := trainMarkov(&markovData); err != nil {
+			log.Println("Error training markov:", err)
+		}
+	case err != nil:
+		log.Printf("Error loading markov data from %s: %s", markovFile(), err)
+	default:
+		log.Printf("Loaded markov data from %s", markovFile())
+	}
+	for {
+		markovData.mutex.RLock()
+		dirty := markovData.dirty
+		markovData.mutex.RUnlock()
+		if dirty {
+			if err := markovData.Save(markovFile()); err != nil {
+				log.Println("Error saving markov data:", err)
+			}
+		}
+		time.Sleep(markovSaveEvery)
 	}
-	markovData.mutex.Unlock()
 }
 
-func init() {
-	log.Println("Loading markov data.")
-	markovData.Init()
-	markovData.mutex.Lock()
+// sadbot rebuild-markov retrains the chain from the whole history.
+// Stop the bot first, or it'll write over it with what it had.
+func rebuildMarkovCommand(args []string) {
+	var m Markov
+	m.Init(markovOrder())
+	if err := trainMarkov(&m); err != nil {
+		log.Fatal(err)
+	}
+	if err := m.Save(markovFile()); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Saved markov data to %s", markovFile())
 }
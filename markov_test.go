@@ -0,0 +1,129 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// go test -run NONE -bench Markov -benchmem -markov.lines 1000000
+var markovBenchLines = flag.Int("markov.lines", 1000000, "how many made up lines the markov benchmarks train on")
+
+// Makes up lines that look a bit like chat, with a few common words and
+// lots of rare ones
+type fakeCorpus struct {
+	random *rand.Rand
+	zipf   *rand.Zipf
+	vocab  []string
+}
+
+func newFakeCorpus(vocabSize int) *fakeCorpus {
+	random := rand.New(rand.NewSource(1))
+	corpus := &fakeCorpus{random: random, zipf: rand.NewZipf(random, 1.1, 1, uint64(vocabSize-1))}
+	for i := 0; i < vocabSize; i++ {
+		corpus.vocab = append(corpus.vocab, fmt.Sprintf("w%x", i))
+	}
+	return corpus
+}
+
+func (corpus *fakeCorpus) word() string {
+	return corpus.vocab[corpus.zipf.Uint64()]
+}
+
+func (corpus *fakeCorpus) line() string {
+	words := make([]string, 3+corpus.random.Intn(18))
+	for i := range words {
+		words[i] = corpus.word()
+	}
+	words[0] = strings.ToUpper(words[0][:1]) + words[0][1:]
+	switch corpus.random.Intn(4) {
+	case 0:
+		words[len(words)-1] += "."
+	case 1:
+		words[len(words)-1] += "?"
+	}
+	return strings.Join(words, " ")
+}
+
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// One big chain shared by the generation benchmarks, since training it
+// takes a while
+var benchChain struct {
+	sync.Once
+	chain  *Markov
+	corpus *fakeCorpus
+	bytes  uint64
+}
+
+func trainedChain() *Markov {
+	benchChain.Do(func() {
+		before := heapInUse()
+		benchChain.corpus = newFakeCorpus(50000)
+		benchChain.chain = &Markov{}
+		benchChain.chain.Init(markovOrder())
+		for i := 0; i < *markovBenchLines; i++ {
+			benchChain.chain.Add(benchChain.corpus.line())
+		}
+		benchChain.bytes = heapInUse() - before
+	})
+	return benchChain.chain
+}
+
+// How much memory the trained chain takes and how big it is
+func reportChain(b *testing.B, chain *Markov) {
+	b.ReportMetric(float64(benchChain.bytes)/(1<<20), "MB/chain")
+	b.ReportMetric(float64(len(chain.words)-firstWord), "words/chain")
+	b.ReportMetric(float64(len(chain.forward)), "keys/chain")
+}
+
+// Making up the lines is part of the time here
+func BenchmarkMarkovAdd(b *testing.B) {
+	corpus := newFakeCorpus(50000)
+	var chain Markov
+	chain.Init(markovOrder())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chain.Add(corpus.line())
+	}
+}
+
+func BenchmarkMarkovGenerate(b *testing.B) {
+	chain := trainedChain()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chain.Generate(1)
+	}
+	b.StopTimer()
+	reportChain(b, chain)
+}
+
+func BenchmarkMarkovGenerateFrom(b *testing.B) {
+	chain := trainedChain()
+	seeds := make([]string, 100)
+	for i := range seeds {
+		seeds[i] = benchChain.corpus.word()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chain.GenerateFrom([]string{seeds[i%len(seeds)]})
+	}
+	b.StopTimer()
+	reportChain(b, chain)
+}
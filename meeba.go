@@ -5,20 +5,19 @@
 package main
 
 import (
+	"log"
 	"strings"
-	"sync"
 	"time"
 
 	irc "github.com/fluffle/goirc/client"
 )
 
-var meebcast = meebCast{status: false}
-
-type meebCast struct {
-	mutex   sync.RWMutex
-	turnOff *time.Timer
-	status  bool
-}
+// The show is on air for as long as this is scheduled, so it survives
+// restarts and goes off by itself after meebcastLength
+const (
+	meebcastOff    = "meebcast off"
+	meebcastLength = 3 * time.Hour
+)
 
 func meeba(conn *irc.Conn, line *irc.Line) {
 	if !strings.HasPrefix(line.Text(), "!meebcast") {
@@ -30,29 +29,21 @@ func meeba(conn *irc.Conn, line *irc.Line) {
 		command = splitline[1]
 	}
 	if line.Nick == "meeba" || line.Nick == "sadbox" {
+		var err error
 		if command == "on" {
-			meebcast.mutex.Lock()
-			meebcast.status = true
-
-			meebcast.turnOff = time.AfterFunc(3*time.Hour, func() {
-				meebcast.mutex.Lock()
-				meebcast.status = false
-				meebcast.mutex.Unlock()
-			})
-
-			meebcast.mutex.Unlock()
+			err = scheduleAction(meebcastOff, line.Nick, time.Now().Add(meebcastLength))
 		} else if command == "off" {
-			meebcast.mutex.Lock()
-			meebcast.status = false
-			if meebcast.turnOff != nil {
-				meebcast.turnOff.Stop()
-			}
-			meebcast.mutex.Unlock()
+			err = cancelAction(meebcastOff)
+		}
+		if err != nil {
+			log.Println("Error switching the meebcast:", err)
 		}
 	}
-	meebcast.mutex.RLock()
-	defer meebcast.mutex.RUnlock()
-	if meebcast.status {
+	onAir, err := actionPending(meebcastOff)
+	if err != nil {
+		log.Println("Error checking the meebcast:", err)
+	}
+	if onAir {
 		go conn.Privmsg(line.Target(), "The meebcats show is \u00030,3on air\u000f! Tune in: http://funkatize.me:8001/stream")
 	} else {
 		go conn.Privmsg(line.Target(), "The meebcats show is \u00030,4off the air\u000f! Tune in: http://funkatize.me:8001/stream")
@@ -0,0 +1,66 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// How many lines of results get sent at once
+const pageSize = 3
+
+// Leftover results from the last search, keyed by channel and nick
+var pages = struct {
+	sync.Mutex
+	lines map[string][]string
+}{lines: make(map[string][]string)}
+
+func pageKey(channel, nick string) string {
+	return strings.ToLower(channel + " " + nick)
+}
+
+// Send the first page of results and hold onto the rest for !more
+func sendPaged(conn *irc.Conn, channel, nick string, results []string) {
+	pages.Lock()
+	defer pages.Unlock()
+	key := pageKey(channel, nick)
+	delete(pages.lines, key)
+	sendPage(conn, channel, nick, key, results)
+}
+
+// Must be called with the pages lock held
+func sendPage(conn *irc.Conn, channel, nick, key string, results []string) {
+	if len(results) > pageSize {
+		pages.lines[key] = results[pageSize:]
+		results = results[:pageSize]
+	} else {
+		delete(pages.lines, key)
+	}
+	for _, result := range results {
+		conn.Privmsg(channel, result)
+	}
+	if remaining := len(pages.lines[key]); remaining > 0 {
+		conn.Privmsg(channel, fmt.Sprintf("%s: %d more, use !more to see them", nick, remaining))
+	}
+}
+
+func more(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!more" {
+		return
+	}
+	pages.Lock()
+	defer pages.Unlock()
+	key := pageKey(line.Target(), line.Nick)
+	results, ok := pages.lines[key]
+	if !ok {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: There's nothing more to show.", line.Nick))
+		return
+	}
+	sendPage(conn, line.Target(), line.Nick, key, results)
+}
@@ -0,0 +1,284 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	optoutTable = `CREATE TABLE IF NOT EXISTS privacy_optouts (
+    Nick VARCHAR(32) NOT NULL,
+    Time DATETIME NOT NULL,
+    PRIMARY KEY (Nick)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	optoutsQuery    = `SELECT Nick FROM privacy_optouts;`
+	addOptoutQuery  = `INSERT IGNORE INTO privacy_optouts (Nick, Time) VALUES (?, ?);`
+	delOptoutQuery  = `DELETE FROM privacy_optouts WHERE Nick = ?;`
+	forgetSeenQuery = `DELETE FROM seen WHERE Nick = ?;`
+	redactQuery     = `DELETE FROM messages WHERE Channel = ? AND ID = ?;`
+	redactedQuery   = `SELECT ID, Nick, Cmd, UNIX_TIMESTAMP(Time), Message FROM messages WHERE Channel = ? AND ID IN (%s);`
+	redactLastQuery = `SELECT ID, Nick, Cmd, UNIX_TIMESTAMP(Time), Message FROM messages WHERE Channel = ? AND Nick = ? ` +
+		`ORDER BY Time DESC, ID DESC LIMIT ?;`
+	// Only if it's still the last thing they said
+	redactSeenQuery  = `DELETE FROM seen WHERE Nick = ? AND Channel = ? AND Message = ?;`
+	purgeBatchQuery  = `SELECT ID, Channel, Nick, Cmd, Message FROM messages WHERE Time < ? ORDER BY ID LIMIT ?;`
+	purgeQuery       = `DELETE FROM messages WHERE Time < ? AND ID <= ?;`
+	anonymiseQuery   = `UPDATE messages SET Ident = '', Host = '', Src = Nick WHERE Time < ? AND Host != '' LIMIT 10000;`
+	retentionBatch   = 10000
+	retentionPeriod  = time.Hour
+	maxRedactedLines = 50
+)
+
+// Tacked onto queries that show or learn from old messages
+const notOptedOut = `Nick NOT IN (SELECT Nick FROM privacy_optouts)`
+
+var optouts = struct {
+	sync.RWMutex
+	nicks map[string]bool
+}{nicks: make(map[string]bool)}
+
+func loadOptouts() {
+	rows, err := db.Query(optoutsQuery)
+	if err != nil {
+		log.Println("Error loading privacy opt-outs:", err)
+		return
+	}
+	defer rows.Close()
+	optouts.Lock()
+	defer optouts.Unlock()
+	for rows.Next() {
+		var nick string
+		if err := rows.Scan(&nick); err != nil {
+			log.Println("Error fetching from the db:", err)
+			return
+		}
+		optouts.nicks[strings.ToLower(nick)] = true
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error fetching from the db:", err)
+	}
+}
+
+// Whether a nick has asked not to be logged, whatever case it's in. The
+// queries use notOptedOut as well, which goes by MySQL's idea of case.
+func optedOut(nick string) bool {
+	optouts.RLock()
+	defer optouts.RUnlock()
+	return optouts.nicks[strings.ToLower(nick)]
+}
+
+func setOptout(nick string, out bool) error {
+	optouts.Lock()
+	defer optouts.Unlock()
+	if out {
+		if _, err := db.Exec(addOptoutQuery, nick, time.Now().UTC()); err != nil {
+			return err
+		}
+		if _, err := db.Exec(forgetSeenQuery, nick); err != nil {
+			return err
+		}
+		optouts.nicks[strings.ToLower(nick)] = true
+		forgetModels(nick)
+		go markovNick(nick, false)
+		return nil
+	}
+	if _, err := db.Exec(delOptoutQuery, nick); err != nil {
+		return err
+	}
+	delete(optouts.nicks, strings.ToLower(nick))
+	go markovNick(nick, true)
+	return nil
+}
+
+func privacy(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!privacy" {
+		return
+	}
+	command := strings.TrimSpace(strings.TrimPrefix(line.Text(), "!privacy"))
+	var result string
+	switch command {
+	case "optout":
+		if err := setOptout(line.Nick, true); err != nil {
+			log.Println("Error updating privacy opt-out:", err)
+			return
+		}
+		result = fmt.Sprintf("%s: I'll stop logging you, and your old lines won't show up in the logs,"+
+			" chatter or word counts anymore.", line.Nick)
+	case "optin":
+		if err := setOptout(line.Nick, false); err != nil {
+			log.Println("Error updating privacy opt-out:", err)
+			return
+		}
+		result = fmt.Sprintf("%s: I'll start logging you again.", line.Nick)
+	default:
+		status := "logging"
+		if optedOut(line.Nick) {
+			status = "not logging"
+		}
+		result = fmt.Sprintf("%s: I'm %s you. optout will stop me logging you and hide what's already"+
+			" logged, optin turns it back on. An admin can !redact specific lines.", line.Nick, status)
+	}
+	conn.Privmsg(line.Target(), result)
+}
+
+// !redact 1234 1235 removes lines by ID (the ones in the log viewer's links)
+// !redact last nick 3 removes the last 3 lines from nick in this channel
+func redact(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!redact" {
+		return
+	}
+	if !isAdmin(line) {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Only admins can do that.", line.Nick))
+		return
+	}
+	args := strings.Fields(line.Text())[1:]
+	if len(args) == 0 {
+		conn.Privmsg(line.Target(), "Example: !redact 1234 1235 or !redact last sadbox 3")
+		return
+	}
+
+	var query string
+	var queryArgs []interface{}
+	if args[0] == "last" {
+		if len(args) < 2 {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: Whose lines?", line.Nick))
+			return
+		}
+		count := 1
+		if len(args) > 2 {
+			var err error
+			count, err = strconv.Atoi(args[2])
+			if err != nil || count < 1 || count > maxRedactedLines {
+				conn.Privmsg(line.Target(), fmt.Sprintf("%s: That doesn't look right...", line.Nick))
+				return
+			}
+		}
+		query, queryArgs = redactLastQuery, []interface{}{line.Target(), args[1], count}
+	} else {
+		var ids []string
+		for _, arg := range args {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s isn't a line number.", line.Nick, arg))
+				return
+			}
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+		list, idArgs := sqlList(ids)
+		query, queryArgs = fmt.Sprintf(redactedQuery, list), append([]interface{}{line.Target()}, idArgs...)
+	}
+	rows, err := db.Query(query, queryArgs...)
+	if err != nil {
+		log.Println("Error redacting lines:", err)
+		return
+	}
+	lines, err := scanLogLines(rows)
+	rows.Close()
+	if err != nil {
+		log.Println("Error redacting lines:", err)
+		return
+	}
+
+	// They shouldn't come back through !seen or !words either
+	var removed int64
+	for _, redacted := range lines {
+		result, err := db.Exec(redactQuery, line.Target(), redacted.ID)
+		if err != nil {
+			log.Println("Error redacting lines:", err)
+			return
+		}
+		affected, _ := result.RowsAffected()
+		removed += affected
+		if affected > 0 {
+			markovLine(line.Target(), redacted.Nick, redacted.Cmd, redacted.Message, false)
+		}
+		if _, err := db.Exec(redactSeenQuery, redacted.Nick, line.Target(), redacted.Message); err != nil {
+			log.Println("Error redacting lines:", err)
+		}
+	}
+	if err := uncountWords(line.Target(), lines); err != nil {
+		log.Println("Error taking redacted lines out of the word counts:", err)
+	}
+	log.Printf("%s redacted %d lines in %s", line.Nick, removed, line.Target())
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: Removed %d lines.", line.Nick, removed))
+}
+
+// Delete a batch of messages from before cutoff, taking them out of the
+// markov chain as they go
+func purgeBatch(cutoff time.Time) (int64, error) {
+	rows, err := db.Query(purgeBatchQuery, cutoff, retentionBatch)
+	if err != nil {
+		return 0, err
+	}
+	type purged struct {
+		channel, nick, cmd, message string
+	}
+	var lines []purged
+	var lastID int64
+	for rows.Next() {
+		var line purged
+		if err := rows.Scan(&lastID, &line.channel, &line.nick, &line.cmd, &line.message); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		lines = append(lines, line)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(lines) == 0 {
+		return 0, nil
+	}
+	result, err := db.Exec(purgeQuery, cutoff, lastID)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		markovLine(line.channel, line.nick, line.cmd, line.message, false)
+	}
+	return result.RowsAffected()
+}
+
+// Drop or strip old messages every so often, according to RetentionDays
+// and RetentionMode in the config.
+func retention() {
+	for {
+		cutoff := time.Now().AddDate(0, 0, -config.RetentionDays).UTC()
+		var total int64
+		for {
+			var affected int64
+			var err error
+			if config.RetentionMode == "anonymise" {
+				var result sql.Result
+				if result, err = db.Exec(anonymiseQuery, cutoff); err == nil {
+					affected, _ = result.RowsAffected()
+				}
+			} else {
+				affected, err = purgeBatch(cutoff)
+			}
+			if err != nil {
+				log.Println("Error applying retention:", err)
+				break
+			}
+			total += affected
+			if affected == 0 {
+				break
+			}
+		}
+		if total > 0 {
+			log.Printf("Retention: cleaned up %d messages older than %s", total, cutoff)
+		}
+		time.Sleep(retentionPeriod)
+	}
+}
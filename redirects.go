@@ -0,0 +1,124 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+	"golang.org/x/net/publicsuffix"
+)
+
+const maxRedirects = 10
+
+// Sites whose whole job is to redirect somewhere else, so it's not
+// suspicious when they land on another domain.
+var shorteners = map[string]bool{
+	"bit.ly":      true,
+	"buff.ly":     true,
+	"goo.gl":      true,
+	"is.gd":       true,
+	"ow.ly":       true,
+	"t.co":        true,
+	"tinyurl.com": true,
+	"youtu.be":    true,
+	"redd.it":     true,
+	"amzn.to":     true,
+	"flic.kr":     true,
+	"git.io":      true,
+}
+
+// One step on the way to the page that was finally served
+type redirectHop struct {
+	URL    *url.URL
+	Status int
+}
+
+// Fetch a URL, keeping track of every redirect on the way. The last hop
+// is always the response that's returned.
+func getFollowingRedirects(target *url.URL) (*http.Response, []redirectHop, error) {
+	var hops []redirectHop
+	client := &http.Client{
+		Timeout: 15 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			hops = append(hops, redirectHop{via[len(via)-1].URL, req.Response.StatusCode})
+			return nil
+		},
+	}
+	resp, err := client.Get(target.String())
+	if err != nil {
+		return nil, hops, err
+	}
+	hops = append(hops, redirectHop{resp.Request.URL, resp.StatusCode})
+	return resp, hops, nil
+}
+
+func baseDomain(host string) string {
+	host = strings.TrimPrefix(strings.ToLower(strings.Split(host, ":")[0]), "www.")
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// The host to show next to a title, with a warning if a link that
+// doesn't look like a shortener ended up on a different site.
+func describeRedirect(postedUrl, finalUrl *url.URL) string {
+	if baseDomain(postedUrl.Host) == baseDomain(finalUrl.Host) {
+		return finalUrl.Host
+	}
+	if shorteners[baseDomain(postedUrl.Host)] {
+		return fmt.Sprintf("%s via %s", finalUrl.Host, postedUrl.Host)
+	}
+	return fmt.Sprintf("%s, redirected from %s!", finalUrl.Host, postedUrl.Host)
+}
+
+// List every hop a link goes through before it gets somewhere
+func expand(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!expand" {
+		return
+	}
+	unparsedURL := strings.TrimSpace(strings.TrimPrefix(line.Text(), "!expand"))
+	if unparsedURL == "" {
+		conn.Privmsg(line.Target(), "Example: !expand http://bit.ly/something")
+		return
+	}
+	if !httpRegex.MatchString(unparsedURL) {
+		unparsedURL = `http://` + unparsedURL
+	}
+	target, err := url.Parse(unparsedURL)
+	if err != nil {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: That doesn't look right...", line.Nick))
+		return
+	}
+	resp, hops, err := getFollowingRedirects(target)
+	if err != nil {
+		log.Println("Error expanding link:", err)
+	} else {
+		resp.Body.Close()
+	}
+	if len(hops) == 0 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I couldn't fetch that.", line.Nick))
+		return
+	}
+	var results []string
+	for _, hop := range hops {
+		results = append(results, fmt.Sprintf("%d %s", hop.Status, hop.URL))
+	}
+	result := fmt.Sprintf("%s: %s", line.Nick, strings.Join(results, " -> "))
+	if err != nil {
+		result += " -> (gave up)"
+	}
+	conn.Privmsg(line.Target(), result)
+}
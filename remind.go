@@ -0,0 +1,415 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	remindersTable = `CREATE TABLE IF NOT EXISTS reminders (
+    ID INT NOT NULL AUTO_INCREMENT,
+    Nick VARCHAR(32) NOT NULL,
+    Target VARCHAR(64) NOT NULL,
+    Mention VARCHAR(32) NOT NULL DEFAULT '',
+    Message TEXT NOT NULL,
+    Action VARCHAR(32) NOT NULL DEFAULT '',
+    Cron VARCHAR(64) NOT NULL DEFAULT '',
+    Due DATETIME NOT NULL,
+    PRIMARY KEY (ID),
+    KEY (Due),
+    KEY (Nick)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	addReminderQuery = `INSERT INTO reminders (Nick, Target, Mention, Message, Action, Cron, Due) ` +
+		`VALUES (?, ?, ?, ?, ?, ?, ?);`
+	reminderColumns     = `ID, Nick, Target, Mention, Message, Action, Cron, UNIX_TIMESTAMP(Due)`
+	dueRemindersQuery   = `SELECT ` + reminderColumns + ` FROM reminders WHERE Due <= ? ORDER BY Due;`
+	nickRemindersQuery  = `SELECT ` + reminderColumns + ` FROM reminders WHERE Nick = ? AND Action = '' ORDER BY Due;`
+	countRemindersQuery = `SELECT COUNT(*) FROM reminders WHERE Nick = ? AND Action = '';`
+	rescheduleQuery     = `UPDATE reminders SET Due = ? WHERE ID = ?;`
+	doneReminderQuery   = `DELETE FROM reminders WHERE ID = ?;`
+	deleteReminderQuery = `DELETE FROM reminders WHERE ID = ? AND Action = '' AND (Nick = ? OR ?);`
+	actionPendingQuery  = `SELECT COUNT(*) FROM reminders WHERE Action = ?;`
+	cancelActionQuery   = `DELETE FROM reminders WHERE Action = ?;`
+	// How often the scheduler looks for reminders that are due
+	reminderCheck = 10 * time.Second
+	// How many reminders one nick can have waiting
+	maxReminders = 10
+	// How far ahead a reminder can be set
+	maxReminderDelay = 5 * 365 * 24 * time.Hour
+	// How close together a recurring reminder can go off, and how many of
+	// its next firings get checked for that
+	minReminderRepeat = time.Hour
+	repeatsChecked    = 24
+)
+
+var reminderDelay = regexp.MustCompile(`^(?:\d+[wdhms])+$`)
+var reminderDelayPart = regexp.MustCompile(`(\d+)([wdhms])`)
+
+var reminderUnits = map[string]time.Duration{
+	"w": 7 * 24 * time.Hour,
+	"d": 24 * time.Hour,
+	"h": time.Hour,
+	"m": time.Minute,
+	"s": time.Second,
+}
+
+// Things other than saying something that can be scheduled, by the name
+// kept in the Action column. Nobody can list or delete these with
+// !remind.
+var scheduledActions = map[string]func(conn *irc.Conn){
+	meebcastOff: func(conn *irc.Conn) { log.Println("The meebcast went off the air by itself") },
+}
+
+type reminder struct {
+	ID      int64
+	Nick    string
+	Target  string
+	Mention string
+	Message string
+	Action  string
+	Cron    string
+	Due     time.Time
+}
+
+// What gets said when a reminder goes off
+func (r reminder) text() string {
+	switch {
+	case r.Mention == "":
+		return fmt.Sprintf("Reminder: %s (from %s)", r.Message, r.Nick)
+	case strings.EqualFold(r.Mention, r.Nick):
+		return fmt.Sprintf("%s: %s", r.Mention, r.Message)
+	}
+	return fmt.Sprintf("%s: %s (from %s)", r.Mention, r.Message, r.Nick)
+}
+
+func queryReminders(query string, args ...interface{}) ([]reminder, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reminders []reminder
+	for rows.Next() {
+		var r reminder
+		var due int64
+		if err := rows.Scan(&r.ID, &r.Nick, &r.Target, &r.Mention, &r.Message, &r.Action, &r.Cron, &due); err != nil {
+			return nil, err
+		}
+		r.Due = time.Unix(due, 0)
+		reminders = append(reminders, r)
+	}
+	return reminders, rows.Err()
+}
+
+// Run something by name at a time, replacing it if it was already
+// scheduled
+func scheduleAction(action, nick string, due time.Time) error {
+	if err := cancelAction(action); err != nil {
+		return err
+	}
+	_, err := db.Exec(addReminderQuery, nick, "", "", "", action, "", due.UTC())
+	return err
+}
+
+func cancelAction(action string) error {
+	_, err := db.Exec(cancelActionQuery, action)
+	return err
+}
+
+func actionPending(action string) (bool, error) {
+	var count int
+	err := db.QueryRow(actionPendingQuery, action).Scan(&count)
+	return count > 0, err
+}
+
+// Set off anything that's due. Each one is moved on to its next time or
+// removed before it fires, so a crash can't set it off twice.
+func fireReminders(conn *irc.Conn) {
+	now := time.Now()
+	reminders, err := queryReminders(dueRemindersQuery, now.UTC())
+	if err != nil {
+		log.Println("Error fetching reminders:", err)
+		return
+	}
+	loc, err := exportLocation("")
+	if err != nil {
+		log.Println("Error loading the timezone, using UTC:", err)
+		loc = time.UTC
+	}
+	for _, r := range reminders {
+		var next time.Time
+		if r.Cron != "" {
+			if schedule, err := parseCron(r.Cron); err != nil {
+				log.Printf("Dropping reminder %d with a bad schedule: %s", r.ID, err)
+			} else {
+				next = schedule.next(now.In(loc))
+			}
+		}
+		if next.IsZero() {
+			_, err = db.Exec(doneReminderQuery, r.ID)
+		} else {
+			_, err = db.Exec(rescheduleQuery, next.UTC(), r.ID)
+		}
+		if err != nil {
+			log.Println("Error updating reminder:", err)
+			continue
+		}
+
+		if r.Action == "" {
+			conn.Privmsg(r.Target, r.text())
+		} else if action, ok := scheduledActions[r.Action]; ok {
+			action(conn)
+		} else {
+			log.Printf("Unknown scheduled action %q", r.Action)
+		}
+	}
+}
+
+func reminderWorker(conn *irc.Conn) {
+	for {
+		fireReminders(conn)
+		time.Sleep(reminderCheck)
+	}
+}
+
+// "2h30m", "3d", "1w2d"
+func parseDelay(arg string) (time.Duration, error) {
+	if !reminderDelay.MatchString(arg) {
+		return 0, fmt.Errorf("I don't understand %q, try something like 2h30m or 3d", arg)
+	}
+	tooLong := fmt.Errorf("that's too far away, reminders can only be set %s ahead", roughDuration(maxReminderDelay))
+	var delay time.Duration
+	for _, part := range reminderDelayPart.FindAllStringSubmatch(arg, -1) {
+		unit := reminderUnits[part[2]]
+		count, err := strconv.ParseInt(part[1], 10, 64)
+		if err != nil || count > int64(maxReminderDelay/unit) {
+			return 0, tooLong
+		}
+		delay += time.Duration(count) * unit
+		if delay > maxReminderDelay {
+			return 0, tooLong
+		}
+	}
+	if delay <= 0 {
+		return 0, fmt.Errorf("that's now")
+	}
+	return delay, nil
+}
+
+// "2014-11-01 09:00", "09:00" (the next time it comes around), either
+// followed by an optional timezone like UTC or America/Chicago. Returns
+// the time and how many args it used.
+func parseAt(args []string) (time.Time, int, error) {
+	loc, err := exportLocation("")
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if len(args) == 0 {
+		return time.Time{}, 0, fmt.Errorf("at when?")
+	}
+	layout, value, used := "15:04", args[0], 1
+	if len(args) > 1 {
+		if _, err := time.Parse("2006-01-02 15:04", args[0]+" "+args[1]); err == nil {
+			layout, value, used = "2006-01-02 15:04", args[0]+" "+args[1], 2
+		}
+	}
+	if len(args) > used {
+		zone := args[used]
+		if zone == "UTC" || strings.Contains(zone, "/") {
+			if loc, err = time.LoadLocation(zone); err != nil {
+				return time.Time{}, 0, fmt.Errorf("I don't know the timezone %q", zone)
+			}
+			used++
+		}
+	}
+	t, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("I don't understand the time %q, try 2014-11-01 09:00 or 09:00", value)
+	}
+	if layout == "15:04" {
+		now := time.Now().In(loc)
+		t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+	return t, used, nil
+}
+
+// Works out when a reminder is for from "in 2h", "at 2014-11-01 09:00 UTC"
+// or "every 0 9 * * 1-5", returning the rest of the args as the message
+func parseWhen(args []string) (due time.Time, cron string, message []string, err error) {
+	if len(args) < 2 {
+		return time.Time{}, "", nil, fmt.Errorf("when?")
+	}
+	switch args[0] {
+	case "in":
+		delay, err := parseDelay(args[1])
+		if err != nil {
+			return time.Time{}, "", nil, err
+		}
+		return time.Now().Add(delay), "", args[2:], nil
+	case "at":
+		due, used, err := parseAt(args[1:])
+		if err != nil {
+			return time.Time{}, "", nil, err
+		}
+		if !due.After(time.Now()) {
+			return time.Time{}, "", nil, fmt.Errorf("that's already happened")
+		}
+		if due.Sub(time.Now()) > maxReminderDelay {
+			return time.Time{}, "", nil, fmt.Errorf("that's too far away, reminders can only be set %s ahead",
+				roughDuration(maxReminderDelay))
+		}
+		return due, "", args[1+used:], nil
+	case "every":
+		if len(args) < 1+len(cronRanges) {
+			return time.Time{}, "", nil, fmt.Errorf("every needs a schedule like 0 9 * * 1-5")
+		}
+		cron = strings.Join(args[1:1+len(cronRanges)], " ")
+		schedule, err := parseCron(cron)
+		if err != nil {
+			return time.Time{}, "", nil, err
+		}
+		loc, err := exportLocation("")
+		if err != nil {
+			return time.Time{}, "", nil, err
+		}
+		// Nobody gets to have the bot say something every minute
+		due = schedule.next(time.Now().In(loc))
+		for i, last := 0, due; i < repeatsChecked; i++ {
+			next := schedule.next(last)
+			if next.IsZero() {
+				break
+			}
+			if next.Sub(last) < minReminderRepeat {
+				return time.Time{}, "", nil, fmt.Errorf("that goes off too often, it has to be at least %s apart",
+					roughDuration(minReminderRepeat))
+			}
+			last = next
+		}
+		return due, cron, args[1+len(cronRanges):], nil
+	}
+	return time.Time{}, "", nil, fmt.Errorf("it has to be in, at or every")
+}
+
+// Your reminders, sent privately
+func listReminders(conn *irc.Conn, line *irc.Line) {
+	reminders, err := queryReminders(nickRemindersQuery, line.Nick)
+	if err != nil {
+		log.Println("Error fetching reminders:", err)
+		return
+	}
+	if len(reminders) == 0 {
+		conn.Privmsg(line.Nick, "You don't have any reminders.")
+		return
+	}
+	for _, r := range reminders {
+		every := ""
+		if r.Cron != "" {
+			every = fmt.Sprintf(", every %s", r.Cron)
+		}
+		conn.Privmsg(line.Nick, fmt.Sprintf("[%d] %s %s%s: %s", r.ID, r.Target, timeUntil(r.Due), every, r.Message))
+	}
+	conn.Privmsg(line.Nick, "!remind delete <number> gets rid of one.")
+}
+
+func deleteReminder(conn *irc.Conn, line *irc.Line, arg string) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s isn't a reminder number, !remind list shows them.",
+			line.Nick, arg))
+		return
+	}
+	result, err := db.Exec(deleteReminderQuery, id, line.Nick, isAdmin(line))
+	if err != nil {
+		log.Println("Error deleting reminder:", err)
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: You don't have a reminder %d.", line.Nick, id))
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: Deleted.", line.Nick))
+}
+
+// !remind me in 2h30m check the oven
+// !remind #geekhack at 2014-11-01 09:00 UTC standup
+// !remind sadbox every 0 9 * * 1-5 standup
+// !remind list, !remind delete 12
+func remind(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!remind" {
+		return
+	}
+	args := strings.Fields(line.Text())[1:]
+	if len(args) > 0 && args[0] == "list" {
+		listReminders(conn, line)
+		return
+	}
+	if len(args) == 2 && args[0] == "delete" {
+		deleteReminder(conn, line, args[1])
+		return
+	}
+	if len(args) < 3 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: !remind me in 2h30m check the oven, !remind #channel"+
+			" at 2014-11-01 09:00 UTC standup or !remind me every 0 9 * * 1-5 standup (minute hour day"+
+			" month weekday). !remind list shows yours.", line.Nick))
+		return
+	}
+
+	who := args[0]
+	target, mention := line.Target(), who
+	switch {
+	case who == "me":
+		mention = line.Nick
+	case strings.HasPrefix(who, "#"):
+		known := false
+		for _, channel := range config.Channels {
+			known = known || strings.EqualFold(channel, who)
+		}
+		if !known {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: I'm not in %s.", line.Nick, who))
+			return
+		}
+		if hiddenChannel(who, line.Target()) {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s is private.", line.Nick, who))
+			return
+		}
+		target, mention = who, ""
+	}
+
+	due, cron, message, err := parseWhen(args[1:])
+	if err == nil && len(message) == 0 {
+		err = fmt.Errorf("remind about what?")
+	}
+	if err != nil {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Sorry, %s", line.Nick, err))
+		return
+	}
+
+	var count int
+	if err := db.QueryRow(countRemindersQuery, line.Nick).Scan(&count); err != nil {
+		log.Println("Error counting reminders:", err)
+		return
+	}
+	if count >= maxReminders {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: You already have %d reminders, !remind delete some first.",
+			line.Nick, count))
+		return
+	}
+	_, err = db.Exec(addReminderQuery, line.Nick, target, mention, strings.Join(message, " "), "", cron, due.UTC())
+	if err != nil {
+		log.Println("Error saving reminder:", err)
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: Okay, %s.", line.Nick, timeUntil(due)))
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDelay(t *testing.T) {
+	for _, test := range []struct {
+		arg  string
+		want time.Duration
+		ok   bool
+	}{
+		{"2h30m", 2*time.Hour + 30*time.Minute, true},
+		{"3d", 72 * time.Hour, true},
+		{"1w2d", 9 * 24 * time.Hour, true},
+		{"90s", 90 * time.Second, true},
+		{"260w", 260 * 7 * 24 * time.Hour, true},
+		{"0m", 0, false},
+		{"300w", 0, false},
+		{"9999999999999h", 0, false},
+		{"99999999999999999999h", 0, false},
+		{"2y", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	} {
+		got, err := parseDelay(test.arg)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseDelay(%q) = %s, %v, wanted %s, ok %t", test.arg, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseWhenEvery(t *testing.T) {
+	for _, test := range []struct {
+		schedule string
+		ok       bool
+	}{
+		{"0 9 * * 1-5", true},
+		{"0 * * * *", true},
+		{"* * * * *", false},
+		{"*/30 * * * *", false},
+		{"0,30 9 * * *", false},
+		{"0 9,10 * * *", true},
+	} {
+		args := append([]string{"every"}, append(strings.Fields(test.schedule), "standup")...)
+		_, cron, message, err := parseWhen(args)
+		if (err == nil) != test.ok {
+			t.Errorf("every %s = %v, wanted ok %t", test.schedule, err, test.ok)
+			continue
+		}
+		if err == nil && (cron != test.schedule || len(message) != 1 || message[0] != "standup") {
+			t.Errorf("every %s = %q, %q", test.schedule, cron, message)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	seenTable = `CREATE TABLE IF NOT EXISTS seen (
+    Nick VARCHAR(32) NOT NULL,
+    Cmd VARCHAR(16) NOT NULL,
+    Channel VARCHAR(64) NOT NULL DEFAULT '',
+    Message TEXT NOT NULL,
+    Time DATETIME NOT NULL,
+    PRIMARY KEY (Nick),
+    KEY (Time)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	updateSeenQuery = `INSERT INTO seen (Nick, Cmd, Channel, Message, Time) VALUES (?, ?, ?, ?, ?) ` +
+		`ON DUPLICATE KEY UPDATE Cmd=VALUES(Cmd), Channel=VALUES(Channel), Message=VALUES(Message), Time=VALUES(Time);`
+	findSeenQuery = `SELECT Nick, Cmd, Channel, Message, UNIX_TIMESTAMP(Time) FROM seen ` +
+		`WHERE Nick LIKE ? ORDER BY Time DESC LIMIT %d;`
+	// How many nicks a wildcard !seen shows
+	seenMatches = 3
+	// How far to follow somebody through nick changes
+	maxNickChain = 5
+)
+
+// The last thing a nick did
+type seenEntry struct {
+	logLine
+	Channel string
+}
+
+func updateSeen(line *irc.Line, channel, message string) error {
+	_, err := db.Exec(updateSeenQuery, line.Nick, line.Cmd, channel, message, line.Time)
+	return err
+}
+
+// Look up nicks with * and ? wildcards, most recent first
+func findSeen(pattern string, limit int) ([]seenEntry, error) {
+	like := strings.NewReplacer("*", "%", "?", "_").Replace(escapeLike(pattern))
+	rows, err := db.Query(fmt.Sprintf(findSeenQuery, limit), like)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []seenEntry
+	for rows.Next() {
+		var entry seenEntry
+		var timestamp int64
+		if err := rows.Scan(&entry.Nick, &entry.Cmd, &entry.Channel, &entry.Message, &timestamp); err != nil {
+			return nil, err
+		}
+		entry.Time = time.Unix(timestamp, 0)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Private channels only get named when asking from inside them, and
+// anything that isn't a channel (like a /msg to the bot) never does
+func hiddenChannel(channel, askedFrom string) bool {
+	if !strings.HasPrefix(channel, "#") {
+		return true
+	}
+	return channel != askedFrom && channelOptions(channel).Private
+}
+
+// "sadbox was last seen in #geekhack 3 days, 2 hours ago saying: hi"
+func describeSeen(entry seenEntry, askedFrom string) string {
+	if entry.Channel != "" && hiddenChannel(entry.Channel, askedFrom) {
+		return fmt.Sprintf("%s was last seen somewhere private %s", entry.Nick, timeAgo(entry.Time))
+	}
+	where := ""
+	if entry.Channel != "" {
+		where = " in " + entry.Channel
+	}
+	switch entry.Cmd {
+	case irc.PRIVMSG:
+		return fmt.Sprintf("%s was last seen%s %s saying: %s", entry.Nick, where, timeAgo(entry.Time), entry.Message)
+	case irc.ACTION:
+		return fmt.Sprintf("%s was last seen%s %s: * %s %s", entry.Nick, where, timeAgo(entry.Time), entry.Nick, entry.Message)
+	}
+	return fmt.Sprintf("%s was last seen%s %s", entry.Nick, where, seenDoing(entry.logLine))
+}
+
+// The channels a nick is in that can be mentioned where they asked
+func visibleChannelsWith(nick, askedFrom string) []string {
+	var channels []string
+	for _, channel := range channelsWith(nick) {
+		if !hiddenChannel(channel, askedFrom) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+func showSeen(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!seen" {
+		return
+	}
+	nick := strings.TrimSpace(strings.TrimPrefix(line.Text(), "!seen"))
+	if nick == "" || nick == "help" {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: !seen nick will tell you the last thing they did,"+
+			" * and ? work as wildcards (!seen sad*).", line.Nick))
+		return
+	}
+
+	entries, err := findSeen(nick, seenMatches)
+	if err != nil {
+		log.Println("Error fetching from the db:", err)
+		return
+	}
+	var results []string
+	for _, entry := range entries {
+		result := describeSeen(entry, line.Target())
+		// Follow them through any nick changes
+		for hops := 0; entry.Cmd == irc.NICK && hops < maxNickChain; hops++ {
+			next, err := findSeen(entry.Message, 1)
+			if err != nil || len(next) == 0 || next[0].Time.Before(entry.Time) {
+				break
+			}
+			entry = next[0]
+			result += ". " + describeSeen(entry, line.Target())
+		}
+		current := entry.Nick
+		if entry.Cmd == irc.NICK {
+			current = entry.Message
+		}
+		if channels := visibleChannelsWith(current, line.Target()); len(channels) > 0 {
+			result += fmt.Sprintf(". %s is in %s right now", current, strings.Join(channels, ", "))
+		}
+		results = append(results, result+".")
+	}
+	if len(results) == 0 {
+		if channels := visibleChannelsWith(nick, line.Target()); len(channels) > 0 {
+			results = append(results, fmt.Sprintf("%s is in %s right now but I haven't seen them do anything.",
+				nick, strings.Join(channels, ", ")))
+		} else {
+			results = append(results, fmt.Sprintf("I haven't seen %s.", nick))
+		}
+	}
+	for _, result := range results {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, result))
+	}
+}
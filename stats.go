@@ -0,0 +1,303 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	spokenLines   = `Channel = ? AND Time >= ? AND Cmd IN ('PRIVMSG', 'ACTION') AND ` + notOptedOut
+	talkersQuery  = `SELECT Nick, COUNT(*) FROM messages WHERE ` + spokenLines + ` GROUP BY Nick ORDER BY COUNT(*) DESC LIMIT ?;`
+	hoursQuery    = `SELECT HOUR(Time), COUNT(*) FROM messages WHERE ` + spokenLines + ` GROUP BY HOUR(Time) ORDER BY HOUR(Time);`
+	wordsPerQuery = `SELECT Nick, SUM(LENGTH(Message) - LENGTH(REPLACE(Message, ' ', '')) + 1) / COUNT(*) ` +
+		`FROM messages WHERE ` + spokenLines + ` GROUP BY Nick HAVING COUNT(*) >= ? ORDER BY 2 DESC LIMIT ?;`
+	wordsQuery   = `SELECT Message FROM messages WHERE ` + spokenLines + `;`
+	linkersQuery = `SELECT Nick, COUNT(*) FROM links WHERE Channel = ? AND Time >= ? AND ` + notOptedOut +
+		` GROUP BY Nick ORDER BY COUNT(*) DESC LIMIT ?;`
+	// Nicks need this many lines before their words per line counts
+	minStatLines      = 50
+	statsRebuildEvery = 6 * time.Hour
+)
+
+// Too common to be interesting in a top words list
+var stopWords = map[string]bool{
+	"that": true, "this": true, "with": true, "have": true, "just": true, "like": true,
+	"what": true, "from": true, "your": true, "they": true, "would": true, "there": true,
+	"about": true, "been": true, "were": true, "when": true, "will": true, "then": true,
+	"them": true, "than": true, "some": true, "dont": true, "yeah": true, "thats": true,
+	"know": true, "really": true, "think": true, "could": true, "its": true, "also": true,
+}
+
+// A name and how much of something it has
+type statCount struct {
+	Name  string
+	Count float64
+}
+
+func countQuery(query string, args ...interface{}) ([]statCount, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []statCount
+	for rows.Next() {
+		var count statCount
+		if err := rows.Scan(&count.Name, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+func topTalkers(channel string, since time.Time, limit int) ([]statCount, error) {
+	return countQuery(talkersQuery, channel, since.UTC(), limit)
+}
+
+// Lines said in each hour of the day (UTC), all 24 of them
+func activeHours(channel string, since time.Time) ([]statCount, error) {
+	counts, err := countQuery(hoursQuery, channel, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	hours := make([]statCount, 24)
+	for i := range hours {
+		hours[i].Name = fmt.Sprintf("%02d:00", i)
+	}
+	for _, count := range counts {
+		var hour int
+		fmt.Sscan(count.Name, &hour)
+		hours[hour%24].Count = count.Count
+	}
+	return hours, nil
+}
+
+func wordsPerLine(channel string, since time.Time, limit int) ([]statCount, error) {
+	return countQuery(wordsPerQuery, channel, since.UTC(), minStatLines, limit)
+}
+
+func topLinkers(channel string, since time.Time, limit int) ([]statCount, error) {
+	return countQuery(linkersQuery, channel, since.UTC(), limit)
+}
+
+// This one has to look at every line, so keep the period short
+func topWords(channel string, since time.Time, limit int) ([]statCount, error) {
+	rows, err := db.Query(wordsQuery, channel, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	words := make(map[string]int)
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			return nil, err
+		}
+		for _, word := range strings.Fields(strings.ToLower(message)) {
+			if strings.Contains(word, "://") {
+				continue
+			}
+			word = removeChars(word, PUNCTUATION)
+			if len(word) < 4 || stopWords[word] {
+				continue
+			}
+			words[word]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var counts []statCount
+	for word, count := range words {
+		counts = append(counts, statCount{word, float64(count)})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count == counts[j].Count {
+			return counts[i].Name < counts[j].Name
+		}
+		return counts[i].Count > counts[j].Count
+	})
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts, nil
+}
+
+func joinCounts(counts []statCount, format string) string {
+	var results []string
+	for _, count := range counts {
+		results = append(results, fmt.Sprintf(format, count.Name, count.Count))
+	}
+	return strings.Join(results, ", ")
+}
+
+// !stats talkers 7d, !stats hours, !stats wpl, !stats words 1d, !stats urls
+func showStats(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!stats" {
+		return
+	}
+	args := strings.Fields(line.Text())[1:]
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	period := "30d"
+	if len(args) > 1 {
+		period = args[1]
+	}
+	since, err := parseTimeArg(period)
+	if err != nil {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, err))
+		return
+	}
+	channel := line.Target()
+
+	var counts []statCount
+	var result string
+	switch command {
+	case "talkers":
+		counts, err = topTalkers(channel, since, 5)
+		result = "Top talkers: " + joinCounts(counts, "%s (%.0f lines)")
+	case "hours":
+		counts, err = activeHours(channel, since)
+		sort.SliceStable(counts, func(i, j int) bool { return counts[i].Count > counts[j].Count })
+		if len(counts) > 3 {
+			counts = counts[:3]
+		}
+		result = "Busiest hours (UTC): " + joinCounts(counts, "%s (%.0f lines)")
+	case "wpl":
+		counts, err = wordsPerLine(channel, since, 5)
+		result = "Most words per line: " + joinCounts(counts, "%s (%.1f)")
+	case "words":
+		counts, err = topWords(channel, since, 10)
+		result = "Most used words: " + joinCounts(counts, "%s (%.0f)")
+	case "urls":
+		counts, err = topLinkers(channel, since, 5)
+		result = "Most links posted: " + joinCounts(counts, "%s (%.0f)")
+	default:
+		result := fmt.Sprintf("%s: !stats talkers, hours, wpl (words per line), words or urls,"+
+			" followed by how far back to look (!stats talkers 7d). It's the last 30 days otherwise.", line.Nick)
+		if config.StatsURL != "" && !channelOptions(channel).Private {
+			result += fmt.Sprintf(" There's more at %s/%s.html", config.StatsURL, channelPath(channel))
+		}
+		conn.Privmsg(line.Target(), result)
+		return
+	}
+	if err != nil {
+		log.Println("Error fetching stats:", err)
+		return
+	}
+	if len(counts) == 0 {
+		result = "I don't have anything for that yet."
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, result))
+}
+
+var statsTmpl = template.Must(template.New("stats").Funcs(template.FuncMap{
+	"percent": func(count, most float64) float64 {
+		if most == 0 {
+			return 0
+		}
+		return count / most * 100
+	},
+	"most": func(counts []statCount) float64 {
+		var most float64
+		for _, count := range counts {
+			if count.Count > most {
+				most = count.Count
+			}
+		}
+		return most
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Channel}} stats</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td { padding: 2px 8px; }
+.bar { background: #2980b9; height: 1em; }
+</style></head><body>
+<h1>{{.Channel}}</h1>
+<p>Last {{.Days}} days, generated {{.Generated.UTC.Format "2006-01-02 15:04"}} UTC.</p>
+{{define "table"}}<table>{{$most := most .}}{{range .}}<tr><td>{{.Name}}</td><td>{{printf "%.1f" .Count}}</td>
+<td style="width:300px"><div class="bar" style="width:{{percent .Count $most}}%"></div></td></tr>{{end}}</table>{{end}}
+<h2>Top talkers</h2>{{template "table" .Talkers}}
+<h2>Activity by hour (UTC)</h2>{{template "table" .Hours}}
+<h2>Words per line</h2>{{template "table" .WordsPerLine}}
+<h2>Most used words</h2>{{template "table" .Words}}
+<h2>Most links posted</h2>{{template "table" .Linkers}}
+</body></html>
+`))
+
+type statsPage struct {
+	Channel      string
+	Days         int
+	Generated    time.Time
+	Talkers      []statCount
+	Hours        []statCount
+	WordsPerLine []statCount
+	Words        []statCount
+	Linkers      []statCount
+}
+
+func writeStatsPage(channel string, days int) error {
+	since := time.Now().AddDate(0, 0, -days)
+	page := statsPage{Channel: channel, Days: days, Generated: time.Now()}
+	var err error
+	if page.Talkers, err = topTalkers(channel, since, 25); err != nil {
+		return err
+	}
+	if page.Hours, err = activeHours(channel, since); err != nil {
+		return err
+	}
+	if page.WordsPerLine, err = wordsPerLine(channel, since, 10); err != nil {
+		return err
+	}
+	if page.Words, err = topWords(channel, since, 25); err != nil {
+		return err
+	}
+	if page.Linkers, err = topLinkers(channel, since, 10); err != nil {
+		return err
+	}
+
+	// Write it somewhere else first so nobody gets half a page
+	filename := filepath.Join(config.StatsDir, channelPath(channel)+".html")
+	file, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := statsTmpl.Execute(file, page); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// Rebuild the stats pages for every channel that isn't private
+func buildStatsPages() {
+	for {
+		for _, channel := range webChannels() {
+			log.Printf("Building stats page for %s", channel)
+			if err := writeStatsPage(channel, 30); err != nil {
+				log.Printf("Error building stats for %s: %s", channel, err)
+			}
+		}
+		time.Sleep(statsRebuildEvery)
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	memosTable = `CREATE TABLE IF NOT EXISTS memos (
+    ID INT NOT NULL AUTO_INCREMENT,
+    Sender VARCHAR(32) NOT NULL,
+    Recipient VARCHAR(32) NOT NULL,
+    Channel VARCHAR(64) NOT NULL,
+    Message TEXT NOT NULL,
+    Private BOOL NOT NULL DEFAULT FALSE,
+    Time DATETIME NOT NULL,
+    PRIMARY KEY (ID),
+    KEY (Recipient),
+    KEY (Sender)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	addMemoQuery    = `INSERT INTO memos (Sender, Recipient, Channel, Message, Private, Time) VALUES (?, ?, ?, ?, ?, ?);`
+	memoCountQuery  = `SELECT COUNT(*) FROM memos WHERE Sender = ?;`
+	recipientsQuery = `SELECT DISTINCT Recipient FROM memos;`
+	memosForQuery   = `SELECT ID, Sender, Channel, Message, Private, UNIX_TIMESTAMP(Time) FROM memos ` +
+		`WHERE Recipient = ? ORDER BY ID;`
+	sentMemosQuery = `SELECT ID, Recipient, Channel, Message, Private, UNIX_TIMESTAMP(Time) FROM memos ` +
+		`WHERE Sender = ? ORDER BY ID;`
+	deliveredQuery   = `DELETE FROM memos WHERE ID = ?;`
+	cancelMemoQuery  = `DELETE FROM memos WHERE Sender = ? AND ID = ?;`
+	cancelMemosQuery = `DELETE FROM memos WHERE Sender = ? AND Recipient = ?;`
+	expireMemosQuery = `DELETE FROM memos WHERE Time < ?;`
+	memoExpiryPeriod = time.Hour
+	// Any more than this get sent privately so the channel isn't flooded
+	maxChannelMemos = 3
+)
+
+var errTooManyMemos = errors.New("too many memos waiting")
+
+// A message left with !tell
+type memo struct {
+	ID      int64
+	Nick    string
+	Channel string
+	Message string
+	Private bool
+	Time    time.Time
+}
+
+// Lowercased nicks that have memos waiting, so the db only gets asked
+// when there's something to deliver
+var memoRecipients = struct {
+	sync.Mutex
+	nicks map[string]bool
+}{nicks: make(map[string]bool)}
+
+func memoLimit() int {
+	if config.MemoLimit < 1 {
+		return 5
+	}
+	return config.MemoLimit
+}
+
+func memoExpiryDays() int {
+	if config.MemoExpiryDays < 1 {
+		return 30
+	}
+	return config.MemoExpiryDays
+}
+
+func loadMemoRecipients() {
+	rows, err := db.Query(recipientsQuery)
+	if err != nil {
+		log.Println("Error loading memo recipients:", err)
+		return
+	}
+	defer rows.Close()
+	nicks := make(map[string]bool)
+	for rows.Next() {
+		var nick string
+		if err := rows.Scan(&nick); err != nil {
+			log.Println("Error fetching from the db:", err)
+			return
+		}
+		nicks[strings.ToLower(nick)] = true
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error fetching from the db:", err)
+		return
+	}
+	memoRecipients.Lock()
+	memoRecipients.nicks = nicks
+	memoRecipients.Unlock()
+}
+
+func queryMemos(query, nick string) ([]memo, error) {
+	rows, err := db.Query(query, nick)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var memos []memo
+	for rows.Next() {
+		var m memo
+		var timestamp int64
+		if err := rows.Scan(&m.ID, &m.Nick, &m.Channel, &m.Message, &m.Private, &timestamp); err != nil {
+			return nil, err
+		}
+		m.Time = time.Unix(timestamp, 0)
+		memos = append(memos, m)
+	}
+	return memos, rows.Err()
+}
+
+func addMemo(sender, recipient, channel, message string, private bool) error {
+	var count int
+	if err := db.QueryRow(memoCountQuery, sender).Scan(&count); err != nil {
+		return err
+	}
+	if count >= memoLimit() {
+		return errTooManyMemos
+	}
+	if _, err := db.Exec(addMemoQuery, sender, recipient, channel, message, private, time.Now().UTC()); err != nil {
+		return err
+	}
+	memoRecipients.Lock()
+	memoRecipients.nicks[strings.ToLower(recipient)] = true
+	memoRecipients.Unlock()
+	return nil
+}
+
+// Hand over anything waiting for a nick, in the channel they showed up in
+// unless it was meant to be private. Memos left in a private channel only
+// get said out loud back in that channel.
+func deliverMemos(conn *irc.Conn, nick, channel string) {
+	memoRecipients.Lock()
+	defer memoRecipients.Unlock()
+	if !memoRecipients.nicks[strings.ToLower(nick)] {
+		return
+	}
+	memos, err := queryMemos(memosForQuery, nick)
+	if err != nil {
+		log.Println("Error fetching memos:", err)
+		return
+	}
+	delete(memoRecipients.nicks, strings.ToLower(nick))
+
+	public := 0
+	for _, m := range memos {
+		// Only the ones fetched, anything left since then waits for next
+		// time. Ones that were cancelled in the meantime don't go out.
+		result, err := db.Exec(deliveredQuery, m.ID)
+		if err != nil {
+			log.Println("Error removing delivered memo:", err)
+			continue
+		}
+		if removed, _ := result.RowsAffected(); removed == 0 {
+			continue
+		}
+		text := fmt.Sprintf("%s: %s said %s: %s", nick, m.Nick, timeAgo(m.Time), m.Message)
+		if m.Private || hiddenChannel(m.Channel, channel) || public >= maxChannelMemos {
+			if strings.HasPrefix(m.Channel, "#") {
+				text += " (in " + m.Channel + ")"
+			}
+			conn.Privmsg(nick, text)
+			continue
+		}
+		conn.Privmsg(channel, text)
+		public++
+	}
+}
+
+// Memos go out when somebody says something or joins
+func tellOnMessage(conn *irc.Conn, line *irc.Line) {
+	if !strings.HasPrefix(line.Target(), "#") {
+		return
+	}
+	deliverMemos(conn, line.Nick, line.Target())
+}
+
+func tellOnJoin(conn *irc.Conn, line *irc.Line) {
+	if line.Nick == conn.Me().Nick {
+		return
+	}
+	deliverMemos(conn, line.Nick, lineArg(line, 0))
+}
+
+// Throw away memos nobody came back for
+func expireMemos() {
+	for {
+		cutoff := time.Now().AddDate(0, 0, -memoExpiryDays()).UTC()
+		result, err := db.Exec(expireMemosQuery, cutoff)
+		if err != nil {
+			log.Println("Error expiring memos:", err)
+		} else if expired, _ := result.RowsAffected(); expired > 0 {
+			log.Printf("Expired %d memos", expired)
+			loadMemoRecipients()
+		}
+		time.Sleep(memoExpiryPeriod)
+	}
+}
+
+// Your memos that haven't been delivered yet, sent privately since
+// they might be
+func listMemos(conn *irc.Conn, line *irc.Line) {
+	memos, err := queryMemos(sentMemosQuery, line.Nick)
+	if err != nil {
+		log.Println("Error fetching memos:", err)
+		return
+	}
+	if len(memos) == 0 {
+		conn.Privmsg(line.Nick, "You don't have any messages waiting.")
+		return
+	}
+	for _, m := range memos {
+		conn.Privmsg(line.Nick, fmt.Sprintf("[%d] for %s, %s: %s", m.ID, m.Nick, timeAgo(m.Time), m.Message))
+	}
+	conn.Privmsg(line.Nick, "!tell cancel <number> or !tell cancel <nick> takes them back.")
+}
+
+func cancelMemos(conn *irc.Conn, line *irc.Line, what string) {
+	query := cancelMemosQuery
+	var arg interface{} = what
+	if id, err := strconv.ParseInt(what, 10, 64); err == nil {
+		query, arg = cancelMemoQuery, id
+	}
+	result, err := db.Exec(query, line.Nick, arg)
+	if err != nil {
+		log.Println("Error cancelling memos:", err)
+		return
+	}
+	cancelled, _ := result.RowsAffected()
+	loadMemoRecipients()
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: Cancelled %d messages.", line.Nick, cancelled))
+}
+
+// !tell sadbox the build is fixed
+// !tell private sadbox psst (or just /msg the bot) delivers it privately
+// !tell list, !tell cancel 12, !tell cancel sadbox
+func tell(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!tell" {
+		return
+	}
+	args := strings.Fields(line.Text())[1:]
+	if len(args) > 0 && args[0] == "list" {
+		listMemos(conn, line)
+		return
+	}
+	if len(args) > 0 && args[0] == "cancel" {
+		if len(args) != 2 {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: Cancel which one? !tell list shows them.", line.Nick))
+			return
+		}
+		cancelMemos(conn, line, args[1])
+		return
+	}
+
+	// A /msg to the bot comes back with the sender as the target
+	private := !strings.HasPrefix(line.Target(), "#")
+	if len(args) > 0 && args[0] == "private" {
+		private, args = true, args[1:]
+	}
+	if len(args) < 2 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: !tell nick message passes it on when they're back."+
+			" !tell private nick message sends it privately, !tell list shows what's waiting and"+
+			" !tell cancel takes it back.", line.Nick))
+		return
+	}
+	recipient := strings.TrimRight(args[0], ":,")
+	switch {
+	case strings.EqualFold(recipient, line.Nick):
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Tell yourself.", line.Nick))
+		return
+	case strings.EqualFold(recipient, conn.Me().Nick):
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I heard you.", line.Nick))
+		return
+	case len(recipient) > 32 || strings.HasPrefix(recipient, "#"):
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: That doesn't look like a nick.", line.Nick))
+		return
+	}
+	message := strings.Join(args[1:], " ")
+	if err := addMemo(line.Nick, recipient, line.Target(), message, private); err != nil {
+		if err == errTooManyMemos {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: You already have %d messages waiting,"+
+				" !tell cancel some first.", line.Nick, memoLimit()))
+			return
+		}
+		log.Println("Error saving memo:", err)
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: I'll pass that on when %s is around.", line.Nick, recipient))
+}
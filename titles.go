@@ -0,0 +1,202 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// Kinds of things link titles can be turned off for
+const (
+	channelKind = "channel"
+	maskKind    = "mask"
+	domainKind  = "domain"
+)
+
+const (
+	titleIgnoreTable = `CREATE TABLE IF NOT EXISTS title_ignores (
+    Kind VARCHAR(16) NOT NULL,
+    Value VARCHAR(255) NOT NULL,
+    PRIMARY KEY (Kind, Value)) ENGINE=InnoDB DEFAULT CHARSET=utf8;`
+	titleIgnoresQuery   = `SELECT Kind, Value FROM title_ignores;`
+	addTitleIgnoreQuery = `INSERT IGNORE INTO title_ignores (Kind, Value) VALUES (?, ?);`
+	delTitleIgnoreQuery = `DELETE FROM title_ignores WHERE Kind = ? AND Value = ?;`
+)
+
+// Opt-outs that were set from IRC, these are kept in the database so
+// they survive restarts and sit alongside the ones from the config.
+var titleIgnores = struct {
+	sync.RWMutex
+	values map[string]map[string]bool
+}{values: make(map[string]map[string]bool)}
+
+func loadTitleIgnores() {
+	rows, err := db.Query(titleIgnoresQuery)
+	if err != nil {
+		log.Println("Error loading title ignores:", err)
+		return
+	}
+	defer rows.Close()
+	titleIgnores.Lock()
+	defer titleIgnores.Unlock()
+	for rows.Next() {
+		var kind, value string
+		if err := rows.Scan(&kind, &value); err != nil {
+			log.Println("Error fetching from the db:", err)
+			return
+		}
+		if titleIgnores.values[kind] == nil {
+			titleIgnores.values[kind] = make(map[string]bool)
+		}
+		titleIgnores.values[kind][value] = true
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error fetching from the db:", err)
+	}
+}
+
+func setTitleIgnore(kind, value string, ignored bool) error {
+	value = strings.ToLower(value)
+	titleIgnores.Lock()
+	defer titleIgnores.Unlock()
+	if ignored {
+		if _, err := db.Exec(addTitleIgnoreQuery, kind, value); err != nil {
+			return err
+		}
+		if titleIgnores.values[kind] == nil {
+			titleIgnores.values[kind] = make(map[string]bool)
+		}
+		titleIgnores.values[kind][value] = true
+		return nil
+	}
+	if _, err := db.Exec(delTitleIgnoreQuery, kind, value); err != nil {
+		return err
+	}
+	delete(titleIgnores.values[kind], value)
+	return nil
+}
+
+// Checks the runtime opt-outs (and the config's domain list) for an
+// exact channel or a domain and any of its parents.
+func titleIgnored(kind, value string) bool {
+	value = strings.ToLower(value)
+	if kind == domainKind {
+		value = strings.TrimPrefix(value, "www.")
+		for _, domain := range config.TitleIgnoreDomains {
+			if domainMatch(strings.ToLower(domain), value) {
+				return true
+			}
+		}
+	}
+	titleIgnores.RLock()
+	defer titleIgnores.RUnlock()
+	if kind != domainKind {
+		return titleIgnores.values[kind][value]
+	}
+	for domain := range titleIgnores.values[domainKind] {
+		if domainMatch(domain, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func domainMatch(domain, host string) bool {
+	host = strings.Split(host, ":")[0]
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// Whether the channel and the person speaking want titles at all
+func titlesWanted(line *irc.Line) bool {
+	if channelOptions(line.Target()).DisableTitles || titleIgnored(channelKind, line.Target()) {
+		return false
+	}
+	for _, mask := range config.TitleIgnoreNicks {
+		if matchMask(mask, line) {
+			return false
+		}
+	}
+	titleIgnores.RLock()
+	defer titleIgnores.RUnlock()
+	for mask := range titleIgnores.values[maskKind] {
+		if matchMask(mask, line) {
+			return false
+		}
+	}
+	return true
+}
+
+func titleSettings(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!titles" {
+		return
+	}
+	splitline := strings.Fields(line.Text())
+	command, arg := "", ""
+	if len(splitline) > 1 {
+		command = splitline[1]
+	}
+	if len(splitline) > 2 {
+		arg = splitline[2]
+	}
+
+	var kind, value string
+	var ignored bool
+	var result string
+	switch command {
+	case "optout":
+		kind, value, ignored = maskKind, line.Nick, true
+		result = fmt.Sprintf("%s: I'll stop showing titles for your links.", line.Nick)
+	case "optin":
+		kind, value, ignored = maskKind, line.Nick, false
+		result = fmt.Sprintf("%s: I'll show titles for your links again.", line.Nick)
+	case "on", "off":
+		kind, value, ignored = channelKind, line.Target(), command == "off"
+		result = fmt.Sprintf("%s: Link titles are now %s in %s.", line.Nick, command, line.Target())
+		if !ignored && channelOptions(line.Target()).DisableTitles {
+			result += " They're still turned off in my config though."
+		}
+	case "ignore":
+		kind, value, ignored = maskKind, arg, true
+		result = fmt.Sprintf("%s: Ignoring links from %s.", line.Nick, arg)
+	case "unignore":
+		kind, value, ignored = maskKind, arg, false
+		result = fmt.Sprintf("%s: No longer ignoring links from %s.", line.Nick, arg)
+	case "ignoredomain":
+		kind, value, ignored = domainKind, strings.TrimPrefix(strings.ToLower(arg), "www."), true
+		result = fmt.Sprintf("%s: Ignoring links to %s.", line.Nick, value)
+	case "unignoredomain":
+		kind, value, ignored = domainKind, strings.TrimPrefix(strings.ToLower(arg), "www."), false
+		result = fmt.Sprintf("%s: No longer ignoring links to %s.", line.Nick, value)
+	default:
+		status := "on"
+		if !titlesWanted(line) {
+			status = "off"
+		}
+		result = fmt.Sprintf("%s: Link titles are %s for you here. optout/optin toggles them for your own links,"+
+			" admins can use on/off for the channel, ignore/unignore for a nick or nick!ident@host"+
+			" and ignoredomain/unignoredomain for a site. Start a line with # or put [nt] in it to skip it.", line.Nick, status)
+		conn.Privmsg(line.Target(), result)
+		return
+	}
+
+	if command != "optout" && command != "optin" && !isAdmin(line) {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Only admins can do that.", line.Nick))
+		return
+	}
+	if value == "" {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: That doesn't look right...", line.Nick))
+		return
+	}
+	if err := setTitleIgnore(kind, value, ignored); err != nil {
+		log.Println("Error updating title ignores:", err)
+		return
+	}
+	conn.Privmsg(line.Target(), result)
+}
@@ -0,0 +1,217 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	urlWorkers   = 8
+	urlQueueSize = 64
+	// How many fetches can be hitting the same host at once
+	perHostFetches = 2
+	// Nobody cares about a title that shows up after this long
+	urlJobTimeout = 30 * time.Second
+)
+
+// A link that somebody posted and is waiting on a title
+type urlJob struct {
+	conn    *irc.Conn
+	channel string
+	nick    string
+	url     *url.URL
+	queued  time.Time
+}
+
+func (j urlJob) expired() bool {
+	return time.Since(j.queued) > urlJobTimeout
+}
+
+var (
+	urlQueue = make(chan string, urlQueueSize)
+
+	// Jobs waiting on each URL that's queued or being fetched, keyed on
+	// the normalized URL so the same link only gets fetched once.
+	inFlight = struct {
+		sync.Mutex
+		jobs map[string][]urlJob
+	}{jobs: make(map[string][]urlJob)}
+
+	// How many fetches are running against each host, and the URLs
+	// waiting for one of them to finish. Hosts drop out once they're
+	// idle.
+	hostFetches = struct {
+		sync.Mutex
+		busy    map[string]int
+		waiting map[string][]string
+	}{busy: make(map[string]int), waiting: make(map[string][]string)}
+)
+
+func startUrlWorkers() {
+	for i := 0; i < urlWorkers; i++ {
+		go urlWorker()
+	}
+}
+
+// Queue up a title fetch, dropping it if the queue is already full
+func queueUrl(conn *irc.Conn, channel, unparsedURL, nick string) {
+	if !httpRegex.MatchString(unparsedURL) {
+		unparsedURL = `http://` + unparsedURL
+	}
+	postedUrl, err := url.Parse(unparsedURL)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if titleIgnored(domainKind, postedUrl.Host) {
+		log.Println("Not fetching title for ignored domain " + postedUrl.Host)
+		return
+	}
+	job := urlJob{conn: conn, channel: channel, nick: nick, url: postedUrl, queued: time.Now()}
+	key := normalizeURL(postedUrl)
+
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if waiting, ok := inFlight.jobs[key]; ok {
+		inFlight.jobs[key] = append(waiting, job)
+		return
+	}
+	select {
+	case urlQueue <- key:
+		inFlight.jobs[key] = []urlJob{job}
+		log.Println("Fetching title for " + postedUrl.String() + " In channel " + channel)
+	default:
+		log.Println("URL queue is full, dropping " + postedUrl.String())
+	}
+}
+
+func urlWorker() {
+	for key := range urlQueue {
+		// Finishing a fetch can hand this worker the next URL waiting on
+		// the same host, along with the host's slot
+		for next := fetchQueued(key, false); next != ""; next = fetchQueued(next, true) {
+		}
+	}
+}
+
+// Fetch one queued URL and tell everybody waiting on it. held is whether
+// its host's slot was handed over already. Returns the next URL for the
+// host if one was waiting, with the slot still held for it.
+func fetchQueued(key string, held bool) string {
+	inFlight.Lock()
+	jobs := inFlight.jobs[key]
+	inFlight.Unlock()
+
+	var title string
+	var hops []redirectHop
+	var next string
+	host := jobs[0].url.Host
+	if !held && !allExpired(jobs) {
+		// Don't sit on a worker waiting for a busy host, leave it with
+		// the host and get on with links to everywhere else
+		taken, parked := takeHost(host, key)
+		if parked {
+			return ""
+		}
+		held = taken
+		if !taken {
+			log.Println("Too many links waiting on " + host + ", dropping " + jobs[0].url.String())
+			inFlight.Lock()
+			delete(inFlight.jobs, key)
+			inFlight.Unlock()
+			return ""
+		}
+	}
+	if held {
+		// It could have run out of time while it was waiting
+		if !allExpired(jobs) {
+			var err error
+			title, hops, err = fetchTitle(jobs[0].url)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		next = releaseHost(host)
+	}
+
+	inFlight.Lock()
+	jobs = inFlight.jobs[key]
+	delete(inFlight.jobs, key)
+	inFlight.Unlock()
+
+	// Everybody gets their own repost check. Somebody who posted it
+	// in the same channel earlier in this batch counts as the first
+	// post, whether or not that's in the db yet.
+	firstPosts := make(map[string]*linkPost)
+	for _, job := range jobs {
+		firstPost, err := findLink(job.channel, job.url)
+		if err != nil {
+			log.Println("Error looking up link history:", err)
+		}
+		if firstPost == nil {
+			firstPost = firstPosts[job.channel]
+		}
+		if firstPost == nil {
+			firstPosts[job.channel] = &linkPost{Nick: job.nick, Time: job.queued}
+		}
+		sendUrl(job, firstPost, title, hops)
+	}
+	return next
+}
+
+func allExpired(jobs []urlJob) bool {
+	for _, job := range jobs {
+		if !job.expired() {
+			return false
+		}
+	}
+	return true
+}
+
+// Start a fetch from a host, unless it already has perHostFetches going.
+// Then the URL waits with the host instead (parked), unless too many
+// already are.
+func takeHost(host, key string) (taken, parked bool) {
+	host = strings.ToLower(host)
+	hostFetches.Lock()
+	defer hostFetches.Unlock()
+	if hostFetches.busy[host] < perHostFetches {
+		hostFetches.busy[host]++
+		return true, false
+	}
+	if len(hostFetches.waiting[host]) >= urlQueueSize {
+		return false, false
+	}
+	hostFetches.waiting[host] = append(hostFetches.waiting[host], key)
+	return false, true
+}
+
+// Done with a host. If anything was waiting on it, the slot goes to that
+// and its key comes back.
+func releaseHost(host string) string {
+	host = strings.ToLower(host)
+	hostFetches.Lock()
+	defer hostFetches.Unlock()
+	if waiting := hostFetches.waiting[host]; len(waiting) > 0 {
+		if len(waiting) == 1 {
+			delete(hostFetches.waiting, host)
+		} else {
+			hostFetches.waiting[host] = waiting[1:]
+		}
+		return waiting[0]
+	}
+	hostFetches.busy[host]--
+	if hostFetches.busy[host] <= 0 {
+		delete(hostFetches.busy, host)
+	}
+	return ""
+}
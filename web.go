@@ -0,0 +1,264 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"hash/fnv"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	dayQuery = `SELECT ID, Nick, Cmd, UNIX_TIMESTAMP(Time), Message FROM messages ` +
+		`WHERE Channel = ? AND Time >= ? AND Time < ? AND ` + notOptedOut + ` ORDER BY Time, ID;`
+	daysQuery = `SELECT DATE(Time), COUNT(*) FROM messages WHERE Channel = ? AND ` + notOptedOut +
+		` GROUP BY DATE(Time) ORDER BY DATE(Time) DESC;`
+	webSearchLimit = 200
+)
+
+var nickColours = []string{
+	"#c0392b", "#d35400", "#b7950b", "#27ae60", "#16a085", "#2980b9",
+	"#8e44ad", "#2c3e50", "#7f8c8d", "#a93226", "#1e8449", "#6c3483",
+}
+
+var webTmpl = template.Must(template.New("web").Funcs(template.FuncMap{
+	"colour": nickColour,
+	"path":   channelPath,
+	"clock":  func(t time.Time) string { return t.UTC().Format("15:04:05") },
+	"day":    func(t time.Time) string { return t.UTC().Format("2006-01-02") },
+	"action": func(cmd string) bool { return cmd == "ACTION" },
+	"event":  describeEvent,
+}).Parse(`{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<style>
+body { font-family: monospace; margin: 1em 2em; }
+a { color: #2980b9; text-decoration: none; }
+.line { white-space: pre-wrap; }
+.line:target { background: #fff3b0; }
+.time { color: #999; }
+.nick { font-weight: bold; }
+.event { color: #999; }
+</style></head><body>
+<p><a href="/">channels</a>{{if .Channel}} / <a href="/logs/{{path .Channel}}/">{{.Channel}}</a>
+<form action="/search" style="display:inline"><input type="hidden" name="channel" value="{{.Channel}}">
+<input name="q" value="{{.Query}}" placeholder="search"> <input name="nick" value="{{.Nick}}" placeholder="nick" size="10"></form>{{end}}</p>
+<h1>{{.Title}}</h1>{{end}}
+{{define "lines"}}{{range .Lines}}<div class="line" id="l{{.ID}}"><a class="time" href="/logs/{{path $.Channel}}/{{day .Time}}#l{{.ID}}">{{if $.Search}}{{day .Time}} {{end}}{{clock .Time}}</a> {{with event .}}<span class="event">-- {{.}}</span>{{else}}{{if action .Cmd}}* <span class="nick" style="color:{{colour .Nick}}">{{.Nick}}</span>{{else}}&lt;<span class="nick" style="color:{{colour .Nick}}">{{.Nick}}</span>&gt;{{end}} {{.Message}}{{end}}</div>
+{{end}}{{end}}
+{{define "index"}}{{template "header" .}}<ul>{{range .Channels}}<li><a href="/logs/{{path .}}/">{{.}}</a></li>{{end}}</ul></body></html>{{end}}
+{{define "days"}}{{template "header" .}}<ul>{{range .Days}}<li><a href="/logs/{{path $.Channel}}/{{.Day}}">{{.Day}}</a> ({{.Lines}} lines)</li>{{end}}</ul></body></html>{{end}}
+{{define "day"}}{{template "header" .}}<p>{{if .Prev}}<a href="{{.Prev}}">&larr; previous day</a>{{end}} {{if .Next}}<a href="{{.Next}}">next day &rarr;</a>{{end}}</p>
+{{template "lines" .}}</body></html>{{end}}
+{{define "search"}}{{template "header" .}}{{template "lines" .}}{{if not .Lines}}<p>Nothing found.</p>{{end}}</body></html>{{end}}
+`))
+
+type webPage struct {
+	Title    string
+	Channel  string
+	Query    string
+	Nick     string
+	Search   bool
+	Channels []string
+	Days     []struct {
+		Day   string
+		Lines int
+	}
+	Lines      []logLine
+	Prev, Next string
+}
+
+// Pick a colour for a nick that stays the same between page loads
+func nickColour(nick string) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(nick)))
+	return nickColours[h.Sum32()%uint32(len(nickColours))]
+}
+
+// Channels go in URLs without their leading #
+func channelPath(channel string) string {
+	return strings.TrimPrefix(channel, "#")
+}
+
+// Only the channels the bot sits in and that aren't private get shown
+func webChannel(path string) (string, bool) {
+	for _, channel := range webChannels() {
+		if strings.EqualFold(channelPath(channel), path) {
+			return channel, true
+		}
+	}
+	return "", false
+}
+
+func webChannels() []string {
+	var channels []string
+	for _, channel := range config.Channels {
+		if !channelOptions(channel).Private {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// Everything needs the token (as ?token= or a cookie) or the basic auth
+// login if either is set in the config.
+func webAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.WebToken == "" && config.WebUser == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if config.WebToken != "" {
+			token := r.URL.Query().Get("token")
+			if token == "" {
+				if cookie, err := r.Cookie("token"); err == nil {
+					token = cookie.Value
+				}
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(config.WebToken)) == 1 {
+				http.SetCookie(w, &http.Cookie{Name: "token", Value: token, Path: "/", HttpOnly: true})
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if config.WebUser != "" {
+			user, pass, ok := r.BasicAuth()
+			if ok && subtle.ConstantTimeCompare([]byte(user), []byte(config.WebUser)) == 1 &&
+				subtle.ConstantTimeCompare([]byte(pass), []byte(config.WebPassword)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="sadbot"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func renderPage(w http.ResponseWriter, name string, page webPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := webTmpl.ExecuteTemplate(w, name, page); err != nil {
+		log.Println("Error rendering page:", err)
+	}
+}
+
+func webIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	renderPage(w, "index", webPage{Title: "Channels", Channels: webChannels()})
+}
+
+// /logs/channel/ lists the days, /logs/channel/2014-10-01 shows one
+func webLogs(w http.ResponseWriter, r *http.Request) {
+	splitpath := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/logs/"), "/", 2)
+	channel, ok := webChannel(splitpath[0])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(splitpath) < 2 || splitpath[1] == "" {
+		webDays(w, channel)
+		return
+	}
+	day, err := time.Parse("2006-01-02", splitpath[1])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	rows, err := db.Query(dayQuery, channel, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		log.Println("Error fetching logs:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	lines, err := scanLogLines(rows)
+	if err != nil {
+		log.Println("Error fetching logs:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	page := webPage{
+		Title:   channel + " " + day.Format("2006-01-02"),
+		Channel: channel,
+		Lines:   lines,
+		Prev:    day.AddDate(0, 0, -1).Format("2006-01-02"),
+	}
+	if next := day.AddDate(0, 0, 1); next.Before(time.Now()) {
+		page.Next = next.Format("2006-01-02")
+	}
+	renderPage(w, "day", page)
+}
+
+func webDays(w http.ResponseWriter, channel string) {
+	rows, err := db.Query(daysQuery, channel)
+	if err != nil {
+		log.Println("Error fetching days:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	page := webPage{Title: channel, Channel: channel}
+	for rows.Next() {
+		var day struct {
+			Day   string
+			Lines int
+		}
+		if err := rows.Scan(&day.Day, &day.Lines); err != nil {
+			log.Println("Error fetching days:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		page.Days = append(page.Days, day)
+	}
+	renderPage(w, "days", page)
+}
+
+func webSearch(w http.ResponseWriter, r *http.Request) {
+	channel, ok := webChannel(channelPath(r.URL.Query().Get("channel")))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	search := logSearch{
+		Channel: channel,
+		Nick:    strings.TrimSpace(r.URL.Query().Get("nick")),
+		Pattern: strings.TrimSpace(r.URL.Query().Get("q")),
+	}
+	page := webPage{
+		Title:   "Search " + channel,
+		Channel: channel,
+		Query:   search.Pattern,
+		Nick:    search.Nick,
+		Search:  true,
+	}
+	if search.Pattern != "" || search.Nick != "" {
+		lines, err := search.run(webSearchLimit)
+		if err != nil {
+			log.Println("Error searching logs:", err)
+			http.Error(w, "Bad search", http.StatusBadRequest)
+			return
+		}
+		page.Lines = lines
+	}
+	renderPage(w, "search", page)
+}
+
+func startWeb() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", webIndex)
+	mux.HandleFunc("/logs/", webLogs)
+	mux.HandleFunc("/search", webSearch)
+	mux.HandleFunc("/export", webExport)
+	if config.StatsDir != "" {
+		mux.Handle("/stats/", http.StripPrefix("/stats/", http.FileServer(http.Dir(config.StatsDir))))
+	}
+	log.Printf("Serving logs on %s", config.WebListen)
+	log.Println(http.ListenAndServe(config.WebListen, webAuth(mux)))
+}
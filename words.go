@@ -0,0 +1,246 @@
+// Copyright 2014 James McGuire. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const (
+	wordLeadersQuery = `SELECT Nick, Count FROM word_counts WHERE Channel = ? AND Word = ? AND Count > 0 AND ` +
+		notOptedOut + ` ORDER BY Count DESC LIMIT ?;`
+	nickWordsQuery = `SELECT Word, Count FROM word_counts WHERE Channel = ? AND Nick = ? AND Count > 0 AND ` +
+		notOptedOut + ` ORDER BY Count DESC;`
+	wordTotalsQuery = `SELECT Word, SUM(Count) FROM word_counts WHERE Channel = ? AND ` + notOptedOut +
+		` GROUP BY Word ORDER BY SUM(Count) DESC;`
+	windowLinesQuery = `SELECT Nick, Message FROM messages WHERE ` + spokenLines + `;`
+	wordLeaders      = 5
+)
+
+// Things !words does that can't be used as names for words
+var wordCommands = map[string]bool{"totals": true, "track": true, "untrack": true, "rebuild": true}
+
+// Count the tracked words said in a channel since a time, by nick. The
+// word_counts table only has running totals so this goes back to the logs.
+func countWindow(channel string, since time.Time) (map[string]map[string]int, error) {
+	rows, err := db.Query(windowLinesQuery, channel, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]map[string]int)
+	for rows.Next() {
+		var nick, message string
+		if err := rows.Scan(&nick, &message); err != nil {
+			return nil, err
+		}
+		if optedOut(nick) {
+			continue
+		}
+		message = strings.ToLower(message)
+		for word, regex := range trackedRegexps() {
+			found := len(regex.FindAllStringIndex(message, -1))
+			if found == 0 {
+				continue
+			}
+			if counts[nick] == nil {
+				counts[nick] = make(map[string]int)
+			}
+			counts[nick][word] += found
+		}
+	}
+	return counts, rows.Err()
+}
+
+func sortedCounts(counts map[string]int, limit int) []statCount {
+	var sorted []statCount
+	for name, count := range counts {
+		if count > 0 {
+			sorted = append(sorted, statCount{name, float64(count)})
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count == sorted[j].Count {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].Count > sorted[j].Count
+	})
+	if limit > 0 && len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+	return sorted
+}
+
+// Top nicks for one word
+func wordLeaderboard(channel, word string, since time.Time) ([]statCount, error) {
+	if since.IsZero() {
+		return countQuery(wordLeadersQuery, channel, word, wordLeaders)
+	}
+	window, err := countWindow(channel, since)
+	if err != nil {
+		return nil, err
+	}
+	nicks := make(map[string]int)
+	for nick, words := range window {
+		nicks[nick] = words[word]
+	}
+	return sortedCounts(nicks, wordLeaders), nil
+}
+
+// Every tracked word for one nick
+func nickWords(channel, nick string, since time.Time) ([]statCount, error) {
+	if since.IsZero() {
+		return countQuery(nickWordsQuery, channel, nick)
+	}
+	words := make(map[string]int)
+	window, err := countWindow(channel, since)
+	if err != nil {
+		return nil, err
+	}
+	for windowNick, counts := range window {
+		if strings.EqualFold(windowNick, nick) {
+			for word, count := range counts {
+				words[word] += count
+			}
+		}
+	}
+	return sortedCounts(words, 0), nil
+}
+
+// How many times each word has been said in a channel
+func wordTotals(channel string, since time.Time) ([]statCount, error) {
+	if since.IsZero() {
+		return countQuery(wordTotalsQuery, channel)
+	}
+	words := make(map[string]int)
+	window, err := countWindow(channel, since)
+	if err != nil {
+		return nil, err
+	}
+	for _, counts := range window {
+		for word, count := range counts {
+			words[word] += count
+		}
+	}
+	return sortedCounts(words, 0), nil
+}
+
+// !words track flippin flip+(in|ing)? starts counting a new word,
+// !words untrack flippin forgets about it and !words rebuild recounts
+// everything from the logs
+func changeTracking(conn *irc.Conn, line *irc.Line, args []string) {
+	if !isAdmin(line) {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Only admins can do that.", line.Nick))
+		return
+	}
+	if args[0] == "rebuild" {
+		if err := genTables(line.Nick); err != nil {
+			log.Println("Error starting the word recount:", err)
+			return
+		}
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: Recounting everything, I'll let you know how it goes.", line.Nick))
+		return
+	}
+	if len(args) < 2 || (args[0] == "track" && len(args) < 3) {
+		conn.Privmsg(line.Target(), "Example: !words track flippin flip+(in|ing)? or !words untrack flippin")
+		return
+	}
+	if args[0] == "untrack" {
+		word, ok := trackedWord(args[1])
+		if !ok {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: I'm not counting %s.", line.Nick, args[1]))
+			return
+		}
+		if err := untrackWord(word); err != nil {
+			log.Println("Error untracking word:", err)
+			return
+		}
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I've stopped counting %s.", line.Nick, word))
+		return
+	}
+	word := args[1]
+	if name, ok := trackedWord(word); ok {
+		word = name
+	}
+	if wordCommands[word] || len(word) > 32 || strings.HasPrefix(word, "@") {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I can't call a word that.", line.Nick))
+		return
+	}
+	if err := trackWord(word, strings.Join(args[2:], " "), line.Nick, false); err != nil {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, err))
+		return
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: Counting %s, I'll let you know when I've been through"+
+		" the logs for the old ones.", line.Nick, word))
+}
+
+// !words fuck, !words @sadbox 7d, !words totals 1w
+func showWords(conn *irc.Conn, line *irc.Line) {
+	if getCommand(line) != "!words" {
+		return
+	}
+	args := strings.Fields(line.Text())[1:]
+	if len(args) > 0 && wordCommands[args[0]] && args[0] != "totals" {
+		changeTracking(conn, line, args)
+		return
+	}
+	if len(args) == 0 || len(trackedWords()) == 0 {
+		conn.Privmsg(line.Target(), fmt.Sprintf("%s: I'm counting %s. Try !words <word>, !words @nick or"+
+			" !words totals, with a period on the end (7d, 1w) for just the recent ones.",
+			line.Nick, strings.Join(trackedWords(), ", ")))
+		return
+	}
+	var since time.Time
+	period := "all time"
+	if len(args) > 1 {
+		var err error
+		since, err = parseTimeArg(args[1])
+		if err != nil {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, err))
+			return
+		}
+		period = fmt.Sprintf("in %s since %s", line.Target(), since.Format("2006-01-02"))
+	}
+
+	var counts []statCount
+	var result string
+	var err error
+	switch {
+	case strings.HasPrefix(args[0], "@"):
+		nick := strings.TrimPrefix(args[0], "@")
+		if optedOut(nick) {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: I'm not counting %s.", line.Nick, nick))
+			return
+		}
+		counts, err = nickWords(line.Target(), nick, since)
+		result = fmt.Sprintf("%s (%s): %s", nick, period, joinCounts(counts, "%s %.0f"))
+	case args[0] == "totals":
+		counts, err = wordTotals(line.Target(), since)
+		result = fmt.Sprintf("Totals (%s): %s", period, joinCounts(counts, "%s %.0f"))
+	default:
+		word, ok := trackedWord(args[0])
+		if !ok {
+			conn.Privmsg(line.Target(), fmt.Sprintf("%s: I'm not counting %s, just %s.",
+				line.Nick, args[0], strings.Join(trackedWords(), ", ")))
+			return
+		}
+		counts, err = wordLeaderboard(line.Target(), word, since)
+		result = fmt.Sprintf("Most %s (%s): %s", word, period, joinCounts(counts, "%s (%.0f)"))
+	}
+	if err != nil {
+		log.Println("Error counting words:", err)
+		return
+	}
+	if len(counts) == 0 {
+		result = "Nobody's said any of that."
+	}
+	conn.Privmsg(line.Target(), fmt.Sprintf("%s: %s", line.Nick, result))
+}